@@ -0,0 +1,311 @@
+package tarutil
+
+// POSIX ACLs are stored by the kernel in the system.posix_acl_* xattrs in a
+// binary form, and in tarballs as PAX records in the text form used by star.
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+	paxACLAccess    = "SCHILY.acl.access"
+	paxACLDefault   = "SCHILY.acl.default"
+
+	aclVersion   = 2
+	aclUndefined = 0xffffffff
+	aclEntrySize = 8
+)
+
+var aclRecords = map[string]string{
+	aclAccessXattr:  paxACLAccess,
+	aclDefaultXattr: paxACLDefault,
+}
+
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+func aclTagName(tag uint16) (string, bool) {
+	switch tag {
+	case aclUserObj, aclUser:
+		return "user", true
+	case aclGroupObj, aclGroup:
+		return "group", true
+	case aclMask:
+		return "mask", true
+	case aclOther:
+		return "other", true
+	}
+	return "", false
+}
+
+// aclTag finds the tag for an entry type, which for users and groups depends
+// on whether the entry has a qualifier.
+func aclTag(name string, qualified bool) (uint16, bool) {
+	switch {
+	case name == "user" && qualified:
+		return aclUser, true
+	case name == "user":
+		return aclUserObj, true
+	case name == "group" && qualified:
+		return aclGroup, true
+	case name == "group":
+		return aclGroupObj, true
+	case name == "mask" && !qualified:
+		return aclMask, true
+	case name == "other" && !qualified:
+		return aclOther, true
+	}
+	return 0, false
+}
+
+func aclPermText(perm uint16) string {
+	text := []byte("rwx")
+	for i := range text {
+		if perm&(4>>uint(i)) == 0 {
+			text[i] = '-'
+		}
+	}
+	return string(text)
+}
+
+func aclPerm(text string) (uint16, bool) {
+	var perm uint16
+	for _, c := range text {
+		switch c {
+		case 'r':
+			perm |= 4
+		case 'w':
+			perm |= 2
+		case 'x':
+			perm |= 1
+		case '-':
+		default:
+			return 0, false
+		}
+	}
+	return perm, true
+}
+
+// decodeACL splits an ACL in its xattr form into its entries.
+func decodeACL(acl []byte) ([]aclEntry, error) {
+	if len(acl) < 4 || (len(acl)-4)%aclEntrySize != 0 || binary.LittleEndian.Uint32(acl) != aclVersion {
+		return nil, errors.Wrap(ErrInvalidACL, "malformed xattr")
+	}
+
+	entries := []aclEntry{}
+	for b := acl[4:]; len(b) > 0; b = b[aclEntrySize:] {
+		entries = append(entries, aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+
+	return entries, nil
+}
+
+// encodeACL converts ACL entries to the xattr form.
+func encodeACL(entries []aclEntry) []byte {
+	// the kernel only accepts entries sorted by tag and id.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	acl := make([]byte, 4, 4+len(entries)*aclEntrySize)
+	binary.LittleEndian.PutUint32(acl, aclVersion)
+	for _, e := range entries {
+		b := make([]byte, aclEntrySize)
+		binary.LittleEndian.PutUint16(b, e.tag)
+		binary.LittleEndian.PutUint16(b[2:], e.perm)
+		binary.LittleEndian.PutUint32(b[4:], e.id)
+		acl = append(acl, b...)
+	}
+
+	return acl
+}
+
+// mapACL translates the qualifiers of the user and group entries of an ACL in
+// its xattr form with mapID and the ID maps in options.
+func mapACL(acl []byte, mapID func(int, []IDMap) (int, bool), options *Options) ([]byte, error) {
+	if options == nil || (len(options.UIDMaps) == 0 && len(options.GIDMaps) == 0) {
+		return acl, nil
+	}
+
+	entries, err := decodeACL(acl)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range entries {
+		maps, kind := options.UIDMaps, "uid"
+		switch e.tag {
+		case aclUser:
+		case aclGroup:
+			maps, kind = options.GIDMaps, "gid"
+		default:
+			continue
+		}
+
+		id, ok := mapID(int(e.id), maps)
+		if !ok {
+			return nil, errors.Wrapf(ErrIDNotMapped, "ACL %s %d", kind, e.id)
+		}
+		entries[i].id = uint32(id)
+	}
+
+	return encodeACL(entries), nil
+}
+
+// aclToText converts an ACL from its xattr form to the text form, with
+// numeric user and group qualifiers.
+func aclToText(acl []byte) (string, error) {
+	decoded, err := decodeACL(acl)
+	if err != nil {
+		return "", err
+	}
+
+	entries := []string{}
+	for _, e := range decoded {
+		name, ok := aclTagName(e.tag)
+		if !ok {
+			return "", errors.Wrapf(ErrInvalidACL, "unknown tag %#x", e.tag)
+		}
+
+		qualifier := ""
+		if e.tag == aclUser || e.tag == aclGroup {
+			qualifier = strconv.FormatUint(uint64(e.id), 10)
+		}
+
+		entries = append(entries, strings.Join([]string{name, qualifier, aclPermText(e.perm)}, ":"))
+	}
+
+	return strings.Join(entries, ","), nil
+}
+
+func parseACLEntry(text string) (aclEntry, error) {
+	// star appends the numeric id to entries qualified by name.
+	fields := strings.Split(text, ":")
+	if len(fields) != 3 && len(fields) != 4 {
+		return aclEntry{}, errors.Wrapf(ErrInvalidACL, "entry %q", text)
+	}
+
+	tag, ok := aclTag(fields[0], fields[1] != "")
+	if !ok {
+		return aclEntry{}, errors.Wrapf(ErrInvalidACL, "entry %q", text)
+	}
+
+	perm, ok := aclPerm(fields[2])
+	if !ok {
+		return aclEntry{}, errors.Wrapf(ErrInvalidACL, "entry %q", text)
+	}
+
+	e := aclEntry{tag: tag, perm: perm, id: aclUndefined}
+	if tag == aclUser || tag == aclGroup {
+		qualifier := fields[1]
+		if len(fields) == 4 {
+			qualifier = fields[3]
+		}
+
+		id, err := strconv.ParseUint(qualifier, 10, 32)
+		if err != nil {
+			return aclEntry{}, errors.Wrapf(ErrInvalidACL, "entry %q has no numeric id", text)
+		}
+		e.id = uint32(id)
+	}
+
+	return e, nil
+}
+
+// aclFromText converts an ACL from the text form to its xattr form.
+func aclFromText(text string) ([]byte, error) {
+	entries := []aclEntry{}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		e, err := parseACLEntry(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return encodeACL(entries), nil
+}
+
+// packACLs moves the ACL xattrs of a header to the PAX records star uses,
+// mapping their user and group qualifiers to the IDs inside the container.
+func packACLs(header *tar.Header, options *Options) error {
+	for xattr, record := range aclRecords {
+		acl, ok := header.Xattrs[xattr]
+		if !ok {
+			continue
+		}
+
+		mapped, err := mapACL([]byte(acl), toContainerID, options)
+		if err != nil {
+			return err
+		}
+
+		text, err := aclToText(mapped)
+		if err != nil {
+			return err
+		}
+
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[record] = text
+		delete(header.Xattrs, xattr)
+	}
+
+	if len(header.Xattrs) == 0 {
+		header.Xattrs = nil
+	}
+
+	return nil
+}
+
+// unpackedACLs returns the ACLs recorded in the PAX records of a header in
+// their xattr form, with their user and group qualifiers mapped to the host.
+func unpackedACLs(header *tar.Header, options *Options) (map[string]string, error) {
+	acls := map[string]string{}
+	for xattr, record := range aclRecords {
+		text, ok := header.PAXRecords[record]
+		if !ok {
+			continue
+		}
+
+		acl, err := aclFromText(text)
+		if err != nil {
+			return nil, err
+		}
+
+		if acl, err = mapACL(acl, toHostID, options); err != nil {
+			return nil, err
+		}
+		acls[xattr] = string(acl)
+	}
+
+	return acls, nil
+}
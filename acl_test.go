@@ -0,0 +1,107 @@
+package tarutil
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestACLText(t *testing.T) {
+	text := "user::rwx,user:1000:r-x,group::r-x,group:50:rw-,mask::rwx,other::r--"
+
+	acl, err := aclFromText(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip, err := aclToText(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if roundTrip != text {
+		t.Fatalf("expected %q, got %q", text, roundTrip)
+	}
+
+	// star qualifies entries by name, followed by the numeric id.
+	starACL, err := aclFromText("other::r--,user::rwx,user:lisa:r-x:1000,group::r-x,group:staff:rw-:50,mask::rwx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(starACL, acl) {
+		t.Fatal("star ACL was not converted to the same xattr")
+	}
+
+	for _, bad := range []string{"user:lisa:rwx", "nobody::rwx", "other::rwz", "mask:1:rwx"} {
+		if _, err := aclFromText(bad); !errors.Is(err, ErrInvalidACL) {
+			t.Fatalf("%q: expected an invalid ACL, got %v", bad, err)
+		}
+	}
+}
+
+func TestPackDefaultACL(t *testing.T) {
+	packDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	dir := filepath.Join(packDir, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	text := "user::rwx,user:1000:rwx,group::r-x,mask::rwx,other::r-x"
+	acl, err := aclFromText(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Lsetxattr(dir, aclDefaultXattr, acl, 0); err != nil {
+		t.Skipf("cannot set ACLs here: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Pack(context.Background(), packDir, buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	headers, err := loopTarAndReturnHeaders(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headers) != 1 || headers[0].PAXRecords[paxACLDefault] != text {
+		t.Fatalf("default ACL was not packed: %#v", headers[0].PAXRecords)
+	}
+
+	if _, ok := headers[0].Xattrs[aclDefaultXattr]; ok {
+		t.Fatal("default ACL was also packed as an xattr")
+	}
+
+	unpackDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(unpackDir)
+
+	if err := Unpack(context.Background(), bytes.NewReader(data), unpackDir, &Options{NoLchown: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Lgetxattr(filepath.Join(unpackDir, "dir"), aclDefaultXattr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored, acl) {
+		t.Fatal("default ACL was not restored")
+	}
+}
@@ -36,11 +36,8 @@ func (o *AUFSWhiteouts) Close() error {
 // HandleEntry is the meat and potatoes of the filter; managing the overlay files.
 func (o *AUFSWhiteouts) HandleEntry(h *tar.Header) (bool, bool, error) {
 	fi := h.FileInfo()
-	if fi.Mode()&os.ModeCharDevice != 0 && h.Devmajor == 0 && h.Devminor == 0 {
-		dir, filename := filepath.Split(h.Name)
-		h.Name = filepath.Join(dir, whiteoutPrefix+filename)
-		h.Typeflag = tar.TypeReg
-		h.Size = 0
+	if isOverlayWhiteout(h) {
+		convertOverlayToWhiteout(h)
 		return false, true, nil
 	}
 
@@ -48,6 +45,7 @@ func (o *AUFSWhiteouts) HandleEntry(h *tar.Header) (bool, bool, error) {
 		opaque, ok := h.Xattrs[overlayOpaqueXattr]
 		if ok && opaque == overlayOpaqueXattrValue {
 			delete(h.Xattrs, overlayOpaqueXattr)
+			delete(h.PAXRecords, paxSchilyXattr+overlayOpaqueXattr)
 			h.Typeflag = tar.TypeReg
 			h.Name = filepath.Join(h.Name, whiteoutOpaqueDir)
 			h.Size = 0
@@ -57,3 +55,14 @@ func (o *AUFSWhiteouts) HandleEntry(h *tar.Header) (bool, bool, error) {
 
 	return true, true, nil
 }
+
+func isOverlayWhiteout(h *tar.Header) bool {
+	return h.Typeflag == tar.TypeChar && h.Devmajor == 0 && h.Devminor == 0
+}
+
+func convertOverlayToWhiteout(h *tar.Header) {
+	dir, filename := filepath.Split(h.Name)
+	h.Name = filepath.Join(dir, whiteoutPrefix+filename)
+	h.Typeflag = tar.TypeReg
+	h.Size = 0
+}
@@ -0,0 +1,169 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// chainStage collects the entries a TarFilter writes itself, so that they can
+// be passed through the filters after it.
+type chainStage struct {
+	buf bytes.Buffer
+	tw  *tar.Writer
+}
+
+func newChainStage() *chainStage {
+	stage := &chainStage{}
+	stage.tw = tar.NewWriter(&stage.buf)
+	return stage
+}
+
+// filterChain is a TarFilter running several filters in one pass.
+type filterChain struct {
+	filters []TarFilter
+	stages  []*chainStage
+	tw      *tar.Writer
+}
+
+// Chain returns a TarFilter which passes each header through the filters in
+// order, so that they share a single tar.Reader and tar.Writer. An entry is
+// only written if every filter wants its header written, and its data is only
+// written if every filter wants that too. Entries a filter writes itself,
+// such as the directories OverlayWhiteouts holds back, are buffered in memory
+// and passed through the filters after it.
+func Chain(filters ...TarFilter) TarFilter {
+	return &filterChain{filters: filters}
+}
+
+// SetTarWriter sets the tar writer for output processing.
+func (c *filterChain) SetTarWriter(tw *tar.Writer) error {
+	if c.tw != nil {
+		return fmt.Errorf("the TarWriter is already set")
+	}
+	c.tw = tw
+
+	for _, f := range c.filters {
+		stage := newChainStage()
+		if err := f.SetTarWriter(stage.tw); err != nil {
+			return err
+		}
+		c.stages = append(c.stages, stage)
+	}
+
+	return nil
+}
+
+// HandleEntry passes the header through each filter of the chain.
+func (c *filterChain) HandleEntry(h *tar.Header) (bool, bool, error) {
+	if c.tw == nil {
+		return false, false, fmt.Errorf("the tarWriter isn't set")
+	}
+	return c.handleEntry(0, h)
+}
+
+func (c *filterChain) handleEntry(first int, h *tar.Header) (bool, bool, error) {
+	writeData := true
+	for i := first; i < len(c.filters); i++ {
+		data, header, err := c.filters[i].HandleEntry(h)
+		if err != nil {
+			return false, false, err
+		}
+
+		if err := c.drain(i); err != nil {
+			return false, false, err
+		}
+
+		if !header {
+			return false, false, nil
+		}
+		writeData = writeData && data
+	}
+
+	return writeData, true, nil
+}
+
+// entries returns the entries written to the stage since it was last read,
+// with their data.
+func (s *chainStage) entries() ([]*Entry, error) {
+	if err := s.tw.Flush(); err != nil && err != tar.ErrWriteAfterClose {
+		return nil, err
+	}
+	if s.buf.Len() == 0 {
+		return nil, nil
+	}
+
+	tr := tar.NewReader(bytes.NewReader(s.buf.Bytes()))
+	defer s.buf.Reset()
+
+	entries := []*Entry{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		// the xattr records were decoded into Xattrs, and would otherwise
+		// bring back the xattrs filters remove.
+		for k := range h.PAXRecords {
+			if strings.HasPrefix(k, paxSchilyXattr) {
+				delete(h.PAXRecords, k)
+			}
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &Entry{Header: h, Body: bytes.NewReader(data)})
+	}
+}
+
+// drain passes the entries filter i wrote itself through the rest of the
+// chain, and writes those which are left.
+func (c *filterChain) drain(i int) error {
+	entries, err := c.stages[i].entries()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		writeData, writeHeader, err := c.handleEntry(i+1, e.Header)
+		if err != nil {
+			return err
+		}
+		if !writeHeader {
+			continue
+		}
+
+		if !writeData {
+			e.Body = nil
+		}
+		if err := writeEntryTo(c.tw, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the filters in order, passing what each writes when closing
+// through those after it, and then closes the tar writer.
+func (c *filterChain) Close() error {
+	for i, f := range c.filters {
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := c.drain(i); err != nil {
+			return err
+		}
+	}
+
+	return c.tw.Close()
+}
@@ -0,0 +1,79 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestChainRoundTrip(t *testing.T) {
+	var (
+		h1 = sha256.New()
+		h2 = sha256.New()
+	)
+	entries, err := loadHeaders("headers.json")
+	if err != nil {
+		t.Fatalf("encountered error loading heders: %v", err)
+	}
+
+	originalTarStream := io.TeeReader(generateTarFromHeaders(entries), h1)
+
+	chainTar, err := FilterTarUsingFilter(originalTarStream, Chain(NewOverlayWhiteouts(), NewAUFSWhiteouts()))
+	if err != nil {
+		t.Fatalf("encountered error with filter: %v", err)
+	}
+
+	io.Copy(h2, chainTar)
+	if fmt.Sprintf("%x", h1.Sum(nil)) != fmt.Sprintf("%x", h2.Sum(nil)) {
+		t.Fatal(errHashChainMismatch)
+	}
+}
+
+func TestChainMatchesNestedFilters(t *testing.T) {
+	headers := []tar.Header{
+		{Name: "emptydir", Typeflag: tar.TypeDir},
+		{Name: "foo", Typeflag: tar.TypeReg},
+		{Name: "bar", Typeflag: tar.TypeDir},
+		{Name: "bar/" + whiteoutOpaqueDir, Typeflag: tar.TypeReg},
+		{Name: "boo", Typeflag: tar.TypeDir},
+		{Name: "boo/" + whiteoutPrefix + "baz", Typeflag: tar.TypeReg},
+		{Name: "lastemptydir", Typeflag: tar.TypeDir},
+	}
+
+	ovlTar, err := FilterTarUsingFilter(generateTarFromHeaders(headers), NewOverlayWhiteouts())
+	if err != nil {
+		t.Fatalf("encountered error with filter: %v", err)
+	}
+	nestedTar, err := FilterTarUsingFilter(ovlTar, NewAUFSWhiteouts())
+	if err != nil {
+		t.Fatalf("encountered error with filter: %v", err)
+	}
+	nested, err := loopTarAndReturnHeaders(nestedTar)
+	if err != nil {
+		t.Fatalf("failed to iterate through the items: %v", err)
+	}
+
+	chainTar, err := FilterTarUsingFilter(generateTarFromHeaders(headers), Chain(NewOverlayWhiteouts(), NewAUFSWhiteouts()))
+	if err != nil {
+		t.Fatalf("encountered error with filter: %v", err)
+	}
+	chained, err := loopTarAndReturnHeaders(chainTar)
+	if err != nil {
+		t.Fatalf("failed to iterate through the items: %v", err)
+	}
+
+	if len(chained) != len(nested) {
+		t.Fatalf("expected %v headers, got %v", len(nested), len(chained))
+	}
+
+	for i := range nested {
+		if chained[i].Name != nested[i].Name || chained[i].Typeflag != nested[i].Typeflag {
+			t.Fatalf("expected %v (%c), got %v (%c)", nested[i].Name, nested[i].Typeflag, chained[i].Name, chained[i].Typeflag)
+		}
+		if len(chained[i].Xattrs) != len(nested[i].Xattrs) {
+			t.Fatalf("expected xattrs %v on %v, got %v", nested[i].Xattrs, nested[i].Name, chained[i].Xattrs)
+		}
+	}
+}
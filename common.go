@@ -5,6 +5,8 @@ const (
 	whiteoutMetaPrefix      = whiteoutPrefix + whiteoutPrefix
 	whiteoutLinkDir         = whiteoutMetaPrefix + "plnk"
 	whiteoutOpaqueDir       = whiteoutMetaPrefix + ".opq"
-	overlayOpaqueXattr      = "trusted.overlay.opaque"
+	overlayXattrPrefix      = "trusted.overlay."
+	overlayOpaqueXattr      = overlayXattrPrefix + "opaque"
 	overlayOpaqueXattrValue = "y"
+	paxSchilyXattr          = "SCHILY.xattr."
 )
@@ -0,0 +1,180 @@
+package tarutil
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression identifies the compression codec of a tar stream.
+type Compression int
+
+const (
+	// CompressionAuto detects the codec from the magic bytes at the start of
+	// the stream.
+	CompressionAuto Compression = iota
+	// CompressionNone is a plain tar stream.
+	CompressionNone
+	// Gzip is a gzip compressed tar stream.
+	Gzip
+	// Zstd is a zstd compressed tar stream.
+	Zstd
+	// Bzip2 is a bzip2 compressed tar stream.
+	Bzip2
+	// Xz is a xz compressed tar stream.
+	Xz
+)
+
+var compressionMagic = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b, 0x08}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{Bzip2, []byte{0x42, 0x5a, 0x68}},
+	{Xz, []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}},
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionAuto:
+		return "auto"
+	case CompressionNone:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
+	}
+
+	return "unknown"
+}
+
+// DetectCompression returns the codec matching the magic bytes at the start
+// of a stream, or CompressionNone.
+func DetectCompression(b []byte) Compression {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(b, m.magic) {
+			return m.compression
+		}
+	}
+
+	return CompressionNone
+}
+
+func checkCompression(c Compression, options *Options) error {
+	if options == nil {
+		return nil
+	}
+
+	for _, forbidden := range options.ForbidCompression {
+		if c == forbidden {
+			return errors.Wrap(ErrForbiddenCompression, c.String())
+		}
+	}
+
+	return nil
+}
+
+// Decompress returns the uncompressed contents of r. The codec is detected
+// from the stream unless options sets one; codecs listed in the options'
+// ForbidCompression are refused with ErrForbiddenCompression.
+func Decompress(r io.Reader, options *Options) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	c := CompressionAuto
+	if options != nil {
+		c = options.Compression
+	}
+
+	if c == CompressionAuto {
+		magic, err := br.Peek(6)
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "detecting compression")
+		}
+		c = DetectCompression(magic)
+	}
+
+	if err := checkCompression(c, options); err != nil {
+		return nil, err
+	}
+
+	switch c {
+	case CompressionNone:
+		return ioutil.NopCloser(br), nil
+	case Gzip:
+		return gzip.NewReader(br)
+	case Zstd:
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case Xz:
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	}
+
+	return nil, errors.Wrap(ErrUnknownCompression, c.String())
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func gzipLevel(level int) int {
+	if level == 0 {
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+// Compress returns a writer compressing into w with the codec and level set
+// in options. Closing it flushes the compressor, but does not close w.
+func Compress(w io.Writer, options *Options) (io.WriteCloser, error) {
+	if options == nil {
+		return nopWriteCloser{w}, nil
+	}
+
+	switch options.Compression {
+	case CompressionAuto, CompressionNone:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		if options.ParallelCompression {
+			return pgzip.NewWriterLevel(w, gzipLevel(options.CompressionLevel))
+		}
+		return gzip.NewWriterLevel(w, gzipLevel(options.CompressionLevel))
+	case Zstd:
+		zstdOptions := []zstd.EOption{}
+		if options.CompressionLevel != 0 {
+			zstdOptions = append(zstdOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.CompressionLevel)))
+		}
+		if !options.ParallelCompression {
+			zstdOptions = append(zstdOptions, zstd.WithEncoderConcurrency(1))
+		}
+		return zstd.NewWriter(w, zstdOptions...)
+	}
+
+	return nil, errors.Wrap(ErrUnsupportedCompression, options.Compression.String())
+}
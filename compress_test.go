@@ -0,0 +1,155 @@
+package tarutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+func compressTar(c Compression, r io.Reader) (*bytes.Buffer, error) {
+	var (
+		buf = new(bytes.Buffer)
+		w   io.WriteCloser
+		err error
+	)
+
+	switch c {
+	case Gzip:
+		w = gzip.NewWriter(buf)
+	case Zstd:
+		w, err = zstd.NewWriter(buf)
+	case Xz:
+		w, err = xz.NewWriter(buf)
+	default:
+		_, err = io.Copy(buf, r)
+		return buf, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+
+	return buf, w.Close()
+}
+
+func TestDetectCompression(t *testing.T) {
+	table := map[Compression][]byte{
+		Gzip:            {0x1f, 0x8b, 0x08, 0x00},
+		Zstd:            {0x28, 0xb5, 0x2f, 0xfd, 0x00},
+		Bzip2:           []byte("BZh91AY&SY"),
+		Xz:              {0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00, 0x00},
+		CompressionNone: []byte("foo0"),
+	}
+
+	for expected, magic := range table {
+		if c := DetectCompression(magic); c != expected {
+			t.Fatalf("expected %v, detected %v", expected, c)
+		}
+	}
+
+	if c := DetectCompression(nil); c != CompressionNone {
+		t.Fatalf("expected no compression for an empty stream, detected %v", c)
+	}
+}
+
+func TestUntarCompressed(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, Gzip, Zstd, Xz} {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		buf, err := compressTar(c, generateTar(25))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Unpack(context.Background(), buf, dir, nil); err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+
+		names, err := readDirNames(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(names) != 25*2 {
+			t.Fatalf("%v: unpacked %d files, not %d", c, len(names), 25*2)
+		}
+	}
+}
+
+func TestUntarForcedCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf, err := compressTar(Gzip, generateTar(25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	err = Unpack(context.Background(), bytes.NewReader(data), dir, &Options{ForbidCompression: []Compression{Gzip}})
+	if !errors.Is(err, ErrForbiddenCompression) {
+		t.Fatalf("expected gzip to be forbidden, got %v", err)
+	}
+
+	if err := Unpack(context.Background(), bytes.NewReader(data), dir, &Options{Compression: CompressionNone}); err == nil {
+		t.Fatal("unpacked a gzip stream as plain tar")
+	}
+
+	if err := Unpack(context.Background(), bytes.NewReader(data), dir, &Options{Compression: Gzip}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterCompressedTar(t *testing.T) {
+	buf, err := compressTar(Zstd, generateTar(25))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := FilterTarUsingFilter(buf, &NullFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := loopTar(fr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if items != 25*2 {
+		t.Fatalf("processed only %v items, not %v", items, 25*2)
+	}
+
+	buf, err = compressTar(Zstd, generateTar(25))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = FilterTarUsingFilterWithOptions(buf, &NullFilter{}, &Options{ForbidCompression: []Compression{Zstd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.Copy(ioutil.Discard, fr)
+	if err := fr.Wait(); !errors.Is(err, ErrForbiddenCompression) {
+		t.Fatalf("expected zstd to be forbidden, got %v", err)
+	}
+}
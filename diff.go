@@ -0,0 +1,355 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type differ struct {
+	ctx     context.Context
+	lower   string
+	upper   string
+	tw      *tarWriter
+	inodes  inodeTable
+	options *Options
+}
+
+// Diff writes a layer tarball into w which turns the lower directory tree
+// into the upper one. Added and modified paths are packed like Pack does,
+// removed paths are written as AUFS whiteouts, and directories whose lower
+// contents were all replaced are marked opaque.
+func Diff(ctx context.Context, lower, upper string, w io.Writer, options *Options) error {
+	_, err := diff(ctx, lower, upper, w, options, false)
+	return err
+}
+
+// DiffWithResult writes a layer tarball like Diff, and returns its digests and
+// size like PackWithResult does.
+func DiffWithResult(ctx context.Context, lower, upper string, w io.Writer, options *Options) (*Result, error) {
+	return diff(ctx, lower, upper, w, options, true)
+}
+
+func diff(ctx context.Context, lower, upper string, w io.Writer, options *Options, wantResult bool) (*Result, error) {
+	pw, err := newPackWriter(w, options, wantResult)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &differ{
+		ctx:     ctx,
+		lower:   lower,
+		upper:   upper,
+		tw:      pw.tw,
+		inodes:  inodeTable{},
+		options: options,
+	}
+
+	if err := d.diffDir("", false); err != nil {
+		pw.abort()
+		return nil, err
+	}
+
+	return pw.Close()
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *differ) lowerNames(rel string) ([]string, error) {
+	dir := filepath.Join(d.lower, rel)
+
+	fi, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, nil
+	}
+
+	return readDirNames(dir)
+}
+
+// diffDir diffs the contents of the directory rel. If opaque is true the
+// lower directory is ignored, and everything in the upper one is written.
+func (d *differ) diffDir(rel string, opaque bool) error {
+	upperNames, err := readDirNames(filepath.Join(d.upper, rel))
+	if err != nil {
+		return err
+	}
+
+	if !opaque {
+		lowerNames, err := d.lowerNames(rel)
+		if err != nil {
+			return err
+		}
+
+		upperSet := stringMap{}
+		for _, name := range upperNames {
+			upperSet[name] = struct{}{}
+		}
+
+		for _, name := range lowerNames {
+			if _, ok := upperSet[name]; !ok {
+				if err := d.writeWhiteout(filepath.Join(rel, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, name := range upperNames {
+		if err := d.diffEntry(filepath.Join(rel, name), opaque); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *differ) diffEntry(rel string, opaque bool) error {
+	select {
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	default:
+	}
+
+	upperPath := filepath.Join(d.upper, rel)
+	upperFi, err := os.Lstat(upperPath)
+	if err != nil {
+		return err
+	}
+
+	var lowerFi os.FileInfo
+	if !opaque {
+		lowerFi, err = os.Lstat(filepath.Join(d.lower, rel))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	switch {
+	case lowerFi == nil:
+		return d.writeTree(upperPath, rel, upperFi)
+	case lowerFi.Mode()&os.ModeType != upperFi.Mode()&os.ModeType:
+		if err := d.writeWhiteout(rel); err != nil {
+			return err
+		}
+		return d.writeTree(upperPath, rel, upperFi)
+	case upperFi.IsDir():
+		return d.diffDirEntry(upperPath, rel, lowerFi, upperFi)
+	}
+
+	changed, err := d.changed(filepath.Join(d.lower, rel), upperPath, lowerFi, upperFi)
+	if err != nil || !changed {
+		return err
+	}
+
+	return writeEntry(d.ctx, d.tw, d.upper, upperPath, rel, upperFi, d.inodes, d.options)
+}
+
+// writeTree writes the entry and, for directories, everything beneath it.
+func (d *differ) writeTree(upperPath, rel string, upperFi os.FileInfo) error {
+	if err := writeEntry(d.ctx, d.tw, d.upper, upperPath, rel, upperFi, d.inodes, d.options); err != nil {
+		return err
+	}
+
+	if upperFi.IsDir() {
+		return d.diffDir(rel, true)
+	}
+
+	return nil
+}
+
+func (d *differ) diffDirEntry(upperPath, rel string, lowerFi, upperFi os.FileInfo) error {
+	replaced, err := d.replaced(rel)
+	if err != nil {
+		return err
+	}
+
+	changed, err := d.changed(filepath.Join(d.lower, rel), upperPath, lowerFi, upperFi)
+	if err != nil {
+		return err
+	}
+
+	if changed || replaced {
+		if err := writeEntry(d.ctx, d.tw, d.upper, upperPath, rel, upperFi, d.inodes, d.options); err != nil {
+			return err
+		}
+	}
+
+	if !replaced {
+		return d.diffDir(rel, false)
+	}
+
+	header, err := prepHeader(upperPath, "", rel, false, upperFi, d.options)
+	if err != nil {
+		return packError("header", rel, upperPath, err)
+	}
+
+	opaqueHeader := opaqueWhiteoutHeader(header)
+	if err := d.tw.WriteHeader(opaqueHeader); err != nil {
+		return newEntryError("write header", opaqueHeader, upperPath, err)
+	}
+
+	return d.diffDir(rel, true)
+}
+
+// replaced returns true if the lower directory had contents and none of them
+// survive in the upper directory.
+func (d *differ) replaced(rel string) (bool, error) {
+	lowerNames, err := d.lowerNames(rel)
+	if err != nil || len(lowerNames) == 0 {
+		return false, err
+	}
+
+	for _, name := range lowerNames {
+		_, err := os.Lstat(filepath.Join(d.upper, rel, name))
+		if err == nil {
+			return false, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (d *differ) writeWhiteout(rel string) error {
+	dir, base := filepath.Split(rel)
+
+	var modTime time.Time
+	if fi, err := os.Lstat(filepath.Join(d.upper, dir)); err == nil {
+		modTime = time.Unix(fi.ModTime().Unix(), 0)
+	}
+
+	header := &tar.Header{
+		Name:     filepath.Join(dir, whiteoutPrefix+base),
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		ModTime:  modTime,
+	}
+	normalizeHeader(header, d.options)
+
+	return newEntryError("write header", header, filepath.Join(d.upper, rel), d.tw.WriteHeader(header))
+}
+
+// changed compares the metadata of a path present in both trees. The content
+// of regular files is only hashed when the metadata cannot tell them apart
+// and the modification times are too coarse to be trusted, e.g. after being
+// unpacked from a tarball.
+func (d *differ) changed(lowerPath, upperPath string, lowerFi, upperFi os.FileInfo) (bool, error) {
+	lowerStat := lowerFi.Sys().(*syscall.Stat_t)
+	upperStat := upperFi.Sys().(*syscall.Stat_t)
+
+	if lowerStat.Dev == upperStat.Dev && lowerStat.Ino == upperStat.Ino {
+		return false, nil
+	}
+
+	if lowerFi.Mode() != upperFi.Mode() ||
+		lowerStat.Uid != upperStat.Uid ||
+		lowerStat.Gid != upperStat.Gid ||
+		lowerStat.Rdev != upperStat.Rdev ||
+		!lowerFi.ModTime().Equal(upperFi.ModTime()) ||
+		(!upperFi.IsDir() && lowerFi.Size() != upperFi.Size()) {
+		return true, nil
+	}
+
+	if changed, err := d.xattrsChanged(lowerPath, upperPath); err != nil || changed {
+		return changed, err
+	}
+
+	switch {
+	case upperFi.Mode()&os.ModeSymlink != 0:
+		lowerLink, err := os.Readlink(lowerPath)
+		if err != nil {
+			return false, err
+		}
+		upperLink, err := os.Readlink(upperPath)
+		if err != nil {
+			return false, err
+		}
+		return lowerLink != upperLink, nil
+	case upperFi.Mode().IsRegular() && upperFi.ModTime().Nanosecond() == 0:
+		return contentChanged(lowerPath, upperPath)
+	}
+
+	return false, nil
+}
+
+func (d *differ) xattrsChanged(lowerPath, upperPath string) (bool, error) {
+	lowerXattrs, err := packedXattrs(lowerPath, d.options)
+	if err != nil {
+		return false, err
+	}
+
+	upperXattrs, err := packedXattrs(upperPath, d.options)
+	if err != nil {
+		return false, err
+	}
+
+	if d.options != nil && d.options.Rootless {
+		lowerOwner, err := Lgetxattr(lowerPath, rootlessXattr)
+		if err != nil {
+			return false, err
+		}
+
+		upperOwner, err := Lgetxattr(upperPath, rootlessXattr)
+		if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(lowerOwner, upperOwner) {
+			return true, nil
+		}
+	}
+
+	return !reflect.DeepEqual(lowerXattrs, upperXattrs), nil
+}
+
+func fileDigest(p string) (digest.Digest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return digest.FromReader(f)
+}
+
+func contentChanged(lowerPath, upperPath string) (bool, error) {
+	lowerDigest, err := fileDigest(lowerPath)
+	if err != nil {
+		return false, err
+	}
+
+	upperDigest, err := fileDigest(upperPath)
+	if err != nil {
+		return false, err
+	}
+
+	return lowerDigest != upperDigest, nil
+}
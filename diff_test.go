@@ -0,0 +1,200 @@
+package tarutil
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type diffFile struct {
+	name    string
+	content string
+	link    string
+	dir     bool
+}
+
+func writeDiffTree(base string, files []diffFile) error {
+	stamp := time.Unix(1500000000, 0)
+
+	for _, file := range files {
+		p := filepath.Join(base, file.name)
+		switch {
+		case file.dir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case file.link != "":
+			if err := os.Symlink(file.link, p); err != nil {
+				return err
+			}
+		default:
+			if err := ioutil.WriteFile(p, []byte(file.content), 0644); err != nil {
+				return err
+			}
+			if err := os.Chtimes(p, stamp, stamp); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func compareTrees(expected, actual string) error {
+	seen := stringMap{}
+
+	err := filepath.Walk(expected, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(expected, p)
+		if err != nil {
+			return err
+		}
+		seen[rel] = struct{}{}
+
+		other := filepath.Join(actual, rel)
+		ofi, err := os.Lstat(other)
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeType != ofi.Mode()&os.ModeType {
+			return errors.Errorf("%q has a different type", rel)
+		}
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			l1, _ := os.Readlink(p)
+			l2, _ := os.Readlink(other)
+			if l1 != l2 {
+				return errors.Errorf("%q links to %q, not %q", rel, l2, l1)
+			}
+		case fi.Mode().IsRegular():
+			c1, _ := ioutil.ReadFile(p)
+			c2, _ := ioutil.ReadFile(other)
+			if !bytes.Equal(c1, c2) {
+				return errors.Errorf("%q has different content", rel)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(actual, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(actual, p)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := seen[rel]; !ok {
+			return errors.Errorf("unexpected path %q", rel)
+		}
+		return nil
+	})
+}
+
+func TestDiff(t *testing.T) {
+	base, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	lower := filepath.Join(base, "lower")
+	upper := filepath.Join(base, "upper")
+	dest := filepath.Join(base, "dest")
+
+	err = writeDiffTree(lower, []diffFile{
+		{name: ".", dir: true},
+		{name: "unchanged", content: "same"},
+		{name: "modified", content: "aaaa"},
+		{name: "removed", content: "removed"},
+		{name: "typechange", content: "file"},
+		{name: "replaced", dir: true},
+		{name: "replaced/old1", content: "old1"},
+		{name: "replaced/old2", content: "old2"},
+		{name: "kept", dir: true},
+		{name: "kept/k1", content: "k1"},
+		{name: "link", link: "unchanged"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeDiffTree(upper, []diffFile{
+		{name: ".", dir: true},
+		{name: "unchanged", content: "same"},
+		{name: "modified", content: "bbbb"},
+		{name: "typechange", dir: true},
+		{name: "typechange/inner", content: "inner"},
+		{name: "replaced", dir: true},
+		{name: "replaced/new1", content: "new1"},
+		{name: "kept", dir: true},
+		{name: "kept/k1", content: "k1"},
+		{name: "kept/k2", content: "k2"},
+		{name: "link", link: "modified"},
+		{name: "added", content: "added"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Pack(context.Background(), lower, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Unpack(context.Background(), buf, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	if err := Diff(context.Background(), lower, upper, buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := loopTarAndReturnHeaders(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := stringMap{}
+	for _, header := range headers {
+		names[header.Name] = struct{}{}
+	}
+
+	for _, name := range []string{"unchanged", "kept/k1"} {
+		if _, ok := names[name]; ok {
+			t.Fatalf("unchanged path %q was included in the diff", name)
+		}
+	}
+
+	for _, name := range []string{whiteoutPrefix + "removed", whiteoutPrefix + "typechange", "replaced/" + whiteoutOpaqueDir, "modified", "added"} {
+		if _, ok := names[name]; !ok {
+			t.Fatalf("expected %q in the diff", name)
+		}
+	}
+
+	if err := Unpack(context.Background(), buf, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := compareTrees(upper, dest); err != nil {
+		t.Fatal(err)
+	}
+}
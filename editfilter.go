@@ -0,0 +1,152 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EditFilter is an EntryFilter which removes entries from a stream, and adds
+// new ones to it.
+type EditFilter struct {
+	remove   *patternMatcher
+	adds     map[string]*Entry
+	children map[string][]string
+	written  map[string]bool
+}
+
+// cleanEntryName returns the name of an entry without leading or trailing
+// slashes and "./" prefixes, so that names can be compared.
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// NewEditFilter creates a filter which removes the entries matching the
+// patterns in remove, and adds the entries in add. The patterns are those of
+// Options.Excludes, so removing a directory removes what is beneath it too.
+//
+// An added entry replaces the entry of the stream with the same name, and is
+// otherwise written right after its parent directory. Added entries take the
+// name of the entry they replace, or are named beneath the name their parent
+// has in the stream, so that "./" prefixes are kept; directories get a
+// trailing slash. Added entries whose
+// parent directory is not in the stream are written at its end. If the size
+// of an added regular file is not set, its body is read into memory to find
+// it.
+func NewEditFilter(remove []string, add []*Entry) (*EditFilter, error) {
+	matcher, err := newPatternMatcher(remove)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &EditFilter{
+		remove:   matcher,
+		adds:     map[string]*Entry{},
+		children: map[string][]string{},
+		written:  map[string]bool{},
+	}
+
+	for _, e := range add {
+		if e.Header == nil || cleanEntryName(e.Header.Name) == "" {
+			return nil, errors.New("added entry has no name")
+		}
+
+		header, body, err := readerHeader(ManifestEntry{Path: e.Header.Name, Reader: e.Body, Header: e.Header})
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %v", e.Header.Name)
+		}
+
+		name := cleanEntryName(header.Name)
+		if _, ok := f.adds[name]; ok {
+			return nil, errors.Errorf("%v is added twice", name)
+		}
+
+		f.adds[name] = &Entry{Header: header, Body: body}
+		parent := cleanEntryName(path.Dir(name))
+		f.children[parent] = append(f.children[parent], name)
+	}
+
+	for _, names := range f.children {
+		sort.Strings(names)
+	}
+
+	return f, nil
+}
+
+// editedName returns name with a trailing slash if header is a directory.
+func editedName(name string, header *tar.Header) string {
+	if header.Typeflag == tar.TypeDir {
+		return name + "/"
+	}
+	return name
+}
+
+// emit returns the added entry name written as entryName, followed by the
+// added entries beneath it.
+func (f *EditFilter) emit(name, entryName string) []*Entry {
+	e := f.adds[name]
+	delete(f.adds, name)
+	f.written[name] = true
+
+	e.Header.Name = editedName(strings.TrimSuffix(entryName, "/"), e.Header)
+	return append([]*Entry{e}, f.emitChildren(name, e.Header.Name)...)
+}
+
+// emitChildren returns the added entries beneath dir, named beneath
+// dirName.
+func (f *EditFilter) emitChildren(dir, dirName string) []*Entry {
+	entries := []*Entry{}
+	for _, name := range f.children[dir] {
+		if _, ok := f.adds[name]; ok {
+			entryName := strings.TrimSuffix(dirName, "/") + "/" + path.Base(name)
+			entries = append(entries, f.emit(name, entryName)...)
+		}
+	}
+	delete(f.children, dir)
+
+	return entries
+}
+
+// FilterEntry removes, replaces or passes the entry through, followed by the
+// entries added to it if it is a directory.
+func (f *EditFilter) FilterEntry(entry *Entry) ([]*Entry, error) {
+	name := cleanEntryName(entry.Header.Name)
+
+	if f.written[name] || f.remove.excluded(name) {
+		return nil, nil
+	}
+
+	if _, ok := f.adds[name]; ok {
+		return f.emit(name, entry.Header.Name), nil
+	}
+
+	if entry.Header.Typeflag != tar.TypeDir {
+		return []*Entry{entry}, nil
+	}
+	return append([]*Entry{entry}, f.emitChildren(name, entry.Header.Name)...), nil
+}
+
+// Flush returns the added entries whose parent directory was not in the
+// stream, in lexical order.
+func (f *EditFilter) Flush() ([]*Entry, error) {
+	names := make([]string, 0, len(f.adds))
+	for name := range f.adds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := []*Entry{}
+	for _, name := range names {
+		// added entries beneath other added entries are written with them.
+		if _, ok := f.adds[name]; !ok {
+			continue
+		}
+
+		entries = append(entries, f.emit(name, name)...)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,98 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEditFilter(t *testing.T) {
+	files := map[string]string{
+		"etc/passwd":       "root:x:0:0:root:/root:/bin/sh\n",
+		"etc/ssl/old.pem":  "old\n",
+		"etc/ssl/keep.txt": "keep\n",
+		"usr/bin/tool":     "#!/bin/sh\n",
+	}
+	input := tarWithContents(t, files, "etc/", "etc/passwd", "etc/ssl/", "etc/ssl/old.pem", "etc/ssl/keep.txt", "usr/", "usr/bin/", "usr/bin/tool")
+
+	f, err := NewEditFilter([]string{"etc/ssl/*.pem", "usr/bin"}, []*Entry{
+		{Header: &tar.Header{Name: "opt/app.conf"}, Body: strings.NewReader("conf\n")},
+		{Header: &tar.Header{Name: "etc/ssl/certs/ca.pem"}, Body: strings.NewReader("ca\n")},
+		{Header: &tar.Header{Name: "etc/ssl/certs/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "./etc/passwd", Mode: 0600}, Body: bytes.NewBufferString("root:x:0:0::/:/bin/false\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := FilterTarUsingEntryFilter(input, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, contents := readContents(t, fr)
+	if err := fr.Wait(); err != nil {
+		t.Fatalf("filtering failed: %v", err)
+	}
+
+	expected := "[etc/ etc/passwd etc/ssl/ etc/ssl/certs/ etc/ssl/certs/ca.pem etc/ssl/keep.txt usr/ opt/app.conf]"
+	if fmt.Sprint(names) != expected {
+		t.Fatalf("expected entries %v, got %v", expected, names)
+	}
+
+	if contents["etc/passwd"] != "root:x:0:0::/:/bin/false\n" {
+		t.Fatalf("etc/passwd was not replaced: %q", contents["etc/passwd"])
+	}
+	if contents["etc/ssl/certs/ca.pem"] != "ca\n" || contents["opt/app.conf"] != "conf\n" {
+		t.Fatalf("added files have the wrong contents: %v", contents)
+	}
+}
+
+func TestEditFilterRoot(t *testing.T) {
+	files := map[string]string{"./etc/passwd": "root:x:0:0:root:/root:/bin/sh\n"}
+	input := tarWithContents(t, files, "./", "./etc/", "./etc/passwd")
+
+	f, err := NewEditFilter(nil, []*Entry{
+		{Header: &tar.Header{Name: "opt", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "/motd"}, Body: strings.NewReader("hello\n")},
+		{Header: &tar.Header{Name: "etc/passwd"}, Body: strings.NewReader("root:x:0:0::/:/bin/false\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := FilterTarUsingEntryFilter(input, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, contents := readContents(t, fr)
+	if err := fr.Wait(); err != nil {
+		t.Fatalf("filtering failed: %v", err)
+	}
+
+	expected := "[./ ./motd ./opt/ ./etc/ ./etc/passwd]"
+	if fmt.Sprint(names) != expected {
+		t.Fatalf("expected entries %v, got %v", expected, names)
+	}
+
+	if contents["./etc/passwd"] != "root:x:0:0::/:/bin/false\n" || contents["./motd"] != "hello\n" {
+		t.Fatalf("edited files have the wrong contents: %v", contents)
+	}
+}
+
+func TestEditFilterDuplicateAdd(t *testing.T) {
+	_, err := NewEditFilter(nil, []*Entry{
+		{Header: &tar.Header{Name: "foo"}},
+		{Header: &tar.Header{Name: "./foo/"}},
+	})
+	if err == nil {
+		t.Fatal("adding an entry twice did not fail")
+	}
+
+	if _, err := NewEditFilter(nil, []*Entry{{}}); err == nil {
+		t.Fatal("adding an entry without a name did not fail")
+	}
+}
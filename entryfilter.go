@@ -0,0 +1,196 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"io"
+)
+
+// Entry is an entry of a tar stream, with the reader for its data.
+type Entry struct {
+	Header *tar.Header
+	// Body supplies Header.Size bytes of data for regular files. It may be
+	// nil for entries without data.
+	Body io.Reader
+}
+
+// EntryFilter is a filter which sees the data of the entries it handles, and
+// can replace it, drop entries or add new ones. Existing TarFilters can be
+// used as EntryFilters through AdaptTarFilter.
+type EntryFilter interface {
+	// FilterEntry returns the entries to write in place of entry, in order.
+	// Returning entry passes it through, and returning nothing drops it. To
+	// replace the data of an entry, set its Body and Header.Size. The Body
+	// of entry reads from the input, so it is only valid until the entries
+	// returned have been written; an entry held back for later must have its
+	// data read first.
+	FilterEntry(entry *Entry) ([]*Entry, error)
+	// Flush is called once the input is exhausted, and returns the entries
+	// to write at the end of the stream.
+	Flush() ([]*Entry, error)
+}
+
+func writeEntryTo(tw *tar.Writer, e *Entry) error {
+	if err := tw.WriteHeader(e.Header); err != nil {
+		return err
+	}
+
+	if e.Body == nil || e.Header.Size == 0 {
+		return nil
+	}
+
+	_, err := io.Copy(tw, e.Body)
+	return err
+}
+
+func writeEntries(tw *tar.Writer, entries []*Entry) error {
+	for _, e := range entries {
+		if err := writeEntryTo(tw, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FilterTarUsingEntryFilter accepts a tar file in the io.Reader and an
+// EntryFilter, and runs the filter on each entry of the reader, like
+// FilterTarUsingFilter does.
+func FilterTarUsingEntryFilter(r io.Reader, f EntryFilter) (*FilterReader, error) {
+	return FilterTarUsingEntryFilterWithOptions(r, f, nil)
+}
+
+// FilterTarUsingEntryFilterWithOptions filters a tar stream like
+// FilterTarUsingEntryFilter, decompressing the input according to the
+// options.
+func FilterTarUsingEntryFilterWithOptions(r io.Reader, f EntryFilter, options *Options) (*FilterReader, error) {
+	return startFilter(r, options, nil, func(tr *tar.Reader, tw *tar.Writer) error {
+		return filterTarEntries(tr, tw, f)
+	})
+}
+
+func filterTarEntries(tr *tar.Reader, tw *tar.Writer, f EntryFilter) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		entries, err := f.FilterEntry(&Entry{Header: hdr, Body: tr})
+		if err != nil {
+			return err
+		}
+
+		if err := writeEntries(tw, entries); err != nil {
+			return err
+		}
+	}
+
+	entries, err := f.Flush()
+	if err != nil {
+		return err
+	}
+
+	if err := writeEntries(tw, entries); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// tarFilterAdapter runs a TarFilter as an EntryFilter.
+type tarFilterAdapter struct {
+	f     TarFilter
+	stage *chainStage
+}
+
+// AdaptTarFilter returns an EntryFilter running the TarFilter f. The entries
+// f writes itself are buffered in memory, and returned before the entry f was
+// handling.
+func AdaptTarFilter(f TarFilter) (EntryFilter, error) {
+	a := &tarFilterAdapter{f: f, stage: newChainStage()}
+	if err := f.SetTarWriter(a.stage.tw); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// FilterEntry passes the header of the entry to the TarFilter.
+func (a *tarFilterAdapter) FilterEntry(entry *Entry) ([]*Entry, error) {
+	writeData, writeHeader, err := a.f.HandleEntry(entry.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := a.stage.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	if !writeHeader {
+		return entries, nil
+	}
+
+	if !writeData {
+		entry.Body = nil
+	}
+	return append(entries, entry), nil
+}
+
+// Flush closes the TarFilter, returning what it writes when closing.
+func (a *tarFilterAdapter) Flush() ([]*Entry, error) {
+	if err := a.f.Close(); err != nil {
+		return nil, err
+	}
+	return a.stage.entries()
+}
+
+// entryChain is an EntryFilter running several filters in one pass.
+type entryChain []EntryFilter
+
+// ChainEntryFilters returns an EntryFilter which passes each entry through
+// the filters in order, each filter seeing the entries returned by the one
+// before it.
+func ChainEntryFilters(filters ...EntryFilter) EntryFilter {
+	return entryChain(filters)
+}
+
+func (c entryChain) filter(first int, entries []*Entry) ([]*Entry, error) {
+	for _, f := range c[first:] {
+		var out []*Entry
+		for _, e := range entries {
+			filtered, err := f.FilterEntry(e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, filtered...)
+		}
+		entries = out
+	}
+
+	return entries, nil
+}
+
+// FilterEntry passes the entry through each filter of the chain.
+func (c entryChain) FilterEntry(entry *Entry) ([]*Entry, error) {
+	return c.filter(0, []*Entry{entry})
+}
+
+// Flush flushes the filters in order, passing what each returns through the
+// filters after it.
+func (c entryChain) Flush() ([]*Entry, error) {
+	var entries []*Entry
+	for i, f := range c {
+		flushed, err := f.Flush()
+		if err != nil {
+			return nil, err
+		}
+
+		flushed, err = c.filter(i+1, flushed)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, flushed...)
+	}
+
+	return entries, nil
+}
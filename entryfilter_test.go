@@ -0,0 +1,172 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// hashFilter appends a line to etc/passwd, and adds a file with the hashes of
+// the files it saw at the end of the stream.
+type hashFilter struct {
+	hashes string
+}
+
+func (h *hashFilter) FilterEntry(e *Entry) ([]*Entry, error) {
+	if e.Header.Typeflag != tar.TypeReg {
+		return []*Entry{e}, nil
+	}
+
+	content, err := ioutil.ReadAll(e.Body)
+	if err != nil {
+		return nil, err
+	}
+	h.hashes += fmt.Sprintf("%x  %s\n", sha256.Sum256(content), e.Header.Name)
+
+	if e.Header.Name == "etc/passwd" {
+		content = append(content, "erikh:x:1000:1000::/home/erikh:/bin/sh\n"...)
+	}
+
+	e.Header.Size = int64(len(content))
+	e.Body = bytes.NewReader(content)
+	return []*Entry{e}, nil
+}
+
+func (h *hashFilter) Flush() ([]*Entry, error) {
+	return []*Entry{{
+		Header: &tar.Header{Name: "hashes", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(h.hashes))},
+		Body:   bytes.NewBufferString(h.hashes),
+	}}, nil
+}
+
+func tarWithContents(t *testing.T, files map[string]string, names ...string) io.Reader {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, name := range names {
+		content, ok := files[name]
+		h := &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+		if ok {
+			h = &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+		}
+
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func readContents(t *testing.T, r io.Reader) ([]string, map[string]string) {
+	var (
+		tr       = tar.NewReader(r)
+		names    []string
+		contents = map[string]string{}
+	)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+		contents[h.Name] = string(content)
+	}
+	return names, contents
+}
+
+func TestEntryFilterReplaceBody(t *testing.T) {
+	files := map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\n",
+		"etc/motd":   "hello\n",
+	}
+
+	fr, err := FilterTarUsingEntryFilter(tarWithContents(t, files, "etc/", "etc/passwd", "etc/motd"), &hashFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, contents := readContents(t, fr)
+	if err := fr.Wait(); err != nil {
+		t.Fatalf("filtering failed: %v", err)
+	}
+
+	if fmt.Sprint(names) != "[etc/ etc/passwd etc/motd hashes]" {
+		t.Fatalf("unexpected entries %v", names)
+	}
+
+	if contents["etc/passwd"] != files["etc/passwd"]+"erikh:x:1000:1000::/home/erikh:/bin/sh\n" {
+		t.Fatalf("etc/passwd was not patched: %q", contents["etc/passwd"])
+	}
+	if contents["etc/motd"] != files["etc/motd"] {
+		t.Fatalf("etc/motd was changed: %q", contents["etc/motd"])
+	}
+
+	hashes := fmt.Sprintf("%x  etc/passwd\n%x  etc/motd\n", sha256.Sum256([]byte(files["etc/passwd"])), sha256.Sum256([]byte(files["etc/motd"])))
+	if contents["hashes"] != hashes {
+		t.Fatalf("expected hashes %q, got %q", hashes, contents["hashes"])
+	}
+}
+
+func TestAdaptTarFilterRoundTrip(t *testing.T) {
+	entries, err := loadHeaders("headers.json")
+	if err != nil {
+		t.Fatalf("encountered error loading heders: %v", err)
+	}
+
+	ovl, err := AdaptTarFilter(NewOverlayWhiteouts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aufs, err := AdaptTarFilter(NewAUFSWhiteouts())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := FilterTarUsingEntryFilter(generateTarFromHeaders(entries), ChainEntryFilters(ovl, &hashFilter{}, aufs))
+	if err != nil {
+		t.Fatalf("encountered error with filter: %v", err)
+	}
+
+	names, _ := readContents(t, fr)
+	if err := fr.Wait(); err != nil {
+		t.Fatalf("filtering failed: %v", err)
+	}
+
+	if len(names) != len(entries)+1 || names[len(names)-1] != "hashes" {
+		t.Fatalf("expected %v entries ending with the hashes, got %v", len(entries)+1, names)
+	}
+
+	// without the hashes the chain should leave the stream as it was.
+	var (
+		h1 = sha256.New()
+		h2 = sha256.New()
+	)
+	ovl, _ = AdaptTarFilter(NewOverlayWhiteouts())
+	aufs, _ = AdaptTarFilter(NewAUFSWhiteouts())
+	originalTarStream := io.TeeReader(generateTarFromHeaders(entries), h1)
+	fr, err = FilterTarUsingEntryFilter(originalTarStream, ChainEntryFilters(ovl, aufs))
+	if err != nil {
+		t.Fatalf("encountered error with filter: %v", err)
+	}
+
+	io.Copy(h2, fr)
+	if fmt.Sprintf("%x", h1.Sum(nil)) != fmt.Sprintf("%x", h2.Sum(nil)) {
+		t.Fatal(errHashChainMismatch)
+	}
+}
@@ -0,0 +1,117 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IDMap maps a range of user or group IDs in a container to a range of IDs on
+// the host, like a line of /proc/self/uid_map.
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// ParseIDMap reads ID mappings in the format of /proc/self/uid_map and
+// /proc/self/gid_map: one mapping per line, giving the first container ID,
+// the first host ID and the size of the range.
+func ParseIDMap(r io.Reader) ([]IDMap, error) {
+	maps := []IDMap{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var m IDMap
+		if _, err := fmt.Sscanf(line, "%d %d %d", &m.ContainerID, &m.HostID, &m.Size); err != nil {
+			return nil, errors.Wrapf(err, "invalid id mapping %q", line)
+		}
+
+		if m.ContainerID < 0 || m.HostID < 0 || m.Size <= 0 {
+			return nil, errors.Errorf("invalid id mapping %q", line)
+		}
+
+		maps = append(maps, m)
+	}
+
+	return maps, scanner.Err()
+}
+
+func toHostID(id int, maps []IDMap) (int, bool) {
+	if len(maps) == 0 {
+		return id, true
+	}
+
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+
+	return 0, false
+}
+
+func toContainerID(id int, maps []IDMap) (int, bool) {
+	if len(maps) == 0 {
+		return id, true
+	}
+
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID, true
+		}
+	}
+
+	return 0, false
+}
+
+// hostIDs returns the host uid and gid which own the entry described by the
+// header.
+func hostIDs(header *tar.Header, options *Options) (int, int, error) {
+	if options == nil {
+		return header.Uid, header.Gid, nil
+	}
+
+	uid, ok := toHostID(header.Uid, options.UIDMaps)
+	if !ok {
+		return 0, 0, errors.Wrapf(ErrIDNotMapped, "uid %d", header.Uid)
+	}
+
+	gid, ok := toHostID(header.Gid, options.GIDMaps)
+	if !ok {
+		return 0, 0, errors.Wrapf(ErrIDNotMapped, "gid %d", header.Gid)
+	}
+
+	return uid, gid, nil
+}
+
+// mapContainerIDs translates the host ownership of a packed header to the
+// ownership inside the container. User and group names are looked up on the
+// host, so they are dropped from mapped headers.
+func mapContainerIDs(header *tar.Header, options *Options) error {
+	if options == nil || (len(options.UIDMaps) == 0 && len(options.GIDMaps) == 0) {
+		return nil
+	}
+
+	uid, ok := toContainerID(header.Uid, options.UIDMaps)
+	if !ok {
+		return errors.Wrapf(ErrIDNotMapped, "uid %d", header.Uid)
+	}
+
+	gid, ok := toContainerID(header.Gid, options.GIDMaps)
+	if !ok {
+		return errors.Wrapf(ErrIDNotMapped, "gid %d", header.Gid)
+	}
+
+	header.Uid, header.Gid = uid, gid
+	header.Uname, header.Gname = "", ""
+	return nil
+}
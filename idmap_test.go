@@ -0,0 +1,153 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseIDMap(t *testing.T) {
+	maps, err := ParseIDMap(strings.NewReader("         0     100000      65536\n 65536 1000 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []IDMap{{0, 100000, 65536}, {65536, 1000, 1}}
+	if len(maps) != len(expected) || maps[0] != expected[0] || maps[1] != expected[1] {
+		t.Fatalf("expected %v, got %v", expected, maps)
+	}
+
+	for _, bad := range []string{"0 100000", "a b c", "0 0 0"} {
+		if _, err := ParseIDMap(strings.NewReader(bad)); err == nil {
+			t.Fatalf("%q: invalid mapping was accepted", bad)
+		}
+	}
+}
+
+func TestUntarIDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &Options{
+		UIDMaps: []IDMap{{ContainerID: 0, HostID: 100000, Size: 1000}},
+		GIDMaps: []IDMap{{ContainerID: 0, HostID: 200000, Size: 1000}},
+	}
+
+	headers := []tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 10, Gid: 20},
+	}
+
+	if err := Unpack(context.Background(), generateTarFromHeaders(headers), dir, options); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat := fi.Sys().(*syscall.Stat_t)
+	if stat.Uid != 100010 || stat.Gid != 200020 {
+		t.Fatalf("expected ownership 100010:200020, got %d:%d", stat.Uid, stat.Gid)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := PackWithOptions(context.Background(), dir, buf, options); err != nil {
+		t.Fatal(err)
+	}
+
+	packed, err := loopTarAndReturnHeaders(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if packed[0].Uid != 10 || packed[0].Gid != 20 {
+		t.Fatalf("expected packed ownership 10:20, got %d:%d", packed[0].Uid, packed[0].Gid)
+	}
+
+	headers = []tar.Header{
+		{Name: "unmapped", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000},
+	}
+
+	err = Unpack(context.Background(), generateTarFromHeaders(headers), dir, options)
+	if !errors.Is(err, ErrIDNotMapped) {
+		t.Fatalf("expected an unmapped id error, got %v", err)
+	}
+
+	if err := PackWithOptions(context.Background(), dir, ioutil.Discard, &Options{UIDMaps: []IDMap{{0, 0, 1}}}); !errors.Is(err, ErrIDNotMapped) {
+		t.Fatalf("expected an unmapped id error from pack, got %v", err)
+	}
+}
+
+func TestUntarUnmappedID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &Options{UIDMaps: []IDMap{{ContainerID: 0, HostID: 100000, Size: 1000}}}
+	headers := []tar.Header{
+		{Name: "unmapped", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000},
+	}
+
+	err = Unpack(context.Background(), generateTarFromHeaders(headers), dir, options)
+	if !errors.Is(err, ErrIDNotMapped) {
+		t.Fatalf("expected an unmapped id error, got %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "unmapped")); !os.IsNotExist(err) {
+		t.Fatalf("the entry with an unmapped id was created: %v", err)
+	}
+}
+
+func TestMapACL(t *testing.T) {
+	options := &Options{
+		UIDMaps: []IDMap{{ContainerID: 0, HostID: 100000, Size: 1000}},
+		GIDMaps: []IDMap{{ContainerID: 0, HostID: 200000, Size: 1000}},
+	}
+
+	acl, err := aclFromText("user::rwx,user:10:r-x,group::r-x,group:20:rw-,mask::rwx,other::r--")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapped, err := mapACL(acl, toHostID, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := aclToText(mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "user::rwx,user:100010:r-x,group::r-x,group:200020:rw-,mask::rwx,other::r--"
+	if text != expected {
+		t.Fatalf("expected %q, got %q", expected, text)
+	}
+
+	if _, err := mapACL(mapped, toHostID, options); !errors.Is(err, ErrIDNotMapped) {
+		t.Fatalf("expected an unmapped id error, got %v", err)
+	}
+
+	header := &tar.Header{PAXRecords: map[string]string{paxACLAccess: "user:5000:rwx"}}
+	if _, err := unpackedACLs(header, options); !errors.Is(err, ErrIDNotMapped) {
+		t.Fatalf("expected an unmapped id error, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package tarutil
+
+// The pattern semantics here follow docker's pkg/fileutils, which is what
+// .dockerignore files are evaluated with.
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type pattern struct {
+	text      string
+	dirs      int
+	exclusion bool
+	re        *regexp.Regexp
+}
+
+func newPattern(text string) (*pattern, error) {
+	p := &pattern{}
+
+	if strings.HasPrefix(text, "!") {
+		p.exclusion = true
+		text = strings.TrimSpace(text[1:])
+		if text == "" {
+			return nil, errors.New("illegal exclusion pattern: \"!\"")
+		}
+	}
+
+	text = strings.TrimPrefix(filepath.Clean(text), "/")
+	if text == "" {
+		text = "."
+	}
+
+	if _, err := filepath.Match(text, "."); err != nil {
+		return nil, errors.Wrapf(err, "pattern %q", text)
+	}
+
+	re, err := regexp.Compile(patternRegexp(text))
+	if err != nil {
+		return nil, errors.Wrapf(err, "pattern %q", text)
+	}
+
+	p.text = text
+	p.dirs = len(strings.Split(text, "/"))
+	p.re = re
+
+	return p, nil
+}
+
+// patternRegexp converts a filepath.Match pattern, extended with "**" to
+// match any number of directories, to a regular expression.
+func patternRegexp(text string) string {
+	var (
+		re    = "^"
+		runes = []rune(text)
+	)
+
+	for i := 0; i < len(runes); i++ {
+		switch ch := runes[i]; {
+		case ch == '*' && i+1 < len(runes) && runes[i+1] == '*':
+			i++
+			if i+1 < len(runes) && runes[i+1] == '/' {
+				i++
+			}
+			if i+1 == len(runes) {
+				re += ".*"
+			} else {
+				re += "(.*/)?"
+			}
+		case ch == '*':
+			re += "[^/]*"
+		case ch == '?':
+			re += "[^/]"
+		case ch == '[':
+			class, end := patternClass(runes, i)
+			re += class
+			i = end
+		case ch == '\\' && i+1 < len(runes):
+			i++
+			re += regexp.QuoteMeta(string(runes[i]))
+		default:
+			re += regexp.QuoteMeta(string(ch))
+		}
+	}
+
+	return re + "$"
+}
+
+// patternClass converts the character class starting at runes[start] to a
+// regular expression, returning it with the index of the closing ']'. Classes
+// never match a '/', and characters escaped with '\' are literal.
+func patternClass(runes []rune, start int) (string, int) {
+	re := "["
+	i := start + 1
+	if i < len(runes) && runes[i] == '^' {
+		re += "^/"
+		i++
+	}
+
+	for ; i < len(runes); i++ {
+		switch ch := runes[i]; {
+		case ch == ']':
+			return re + "]", i
+		case ch == '\\' && i+1 < len(runes):
+			i++
+			re += regexp.QuoteMeta(string(runes[i]))
+		case ch == '-':
+			re += "-"
+		case ch == '[':
+			re += "\\["
+		default:
+			re += regexp.QuoteMeta(string(ch))
+		}
+	}
+
+	// filepath.Match rejects unterminated classes, so this is not reached
+	// for validated patterns.
+	return regexp.QuoteMeta("["), start
+}
+
+func (p *pattern) match(rel string) bool {
+	if p.re.MatchString(rel) {
+		return true
+	}
+
+	// a pattern matching a parent directory matches everything beneath it.
+	parts := strings.Split(rel, "/")
+	if len(parts) > p.dirs {
+		return p.re.MatchString(strings.Join(parts[:p.dirs], "/"))
+	}
+
+	return false
+}
+
+// patternMatcher decides which paths are excluded by a list of patterns. As
+// with .dockerignore files, the last matching pattern wins and patterns
+// starting with "!" re-include what earlier patterns excluded.
+type patternMatcher struct {
+	patterns   []*pattern
+	exclusions bool
+}
+
+func newPatternMatcher(patterns []string) (*patternMatcher, error) {
+	pm := &patternMatcher{}
+
+	for _, text := range patterns {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		p, err := newPattern(text)
+		if err != nil {
+			return nil, err
+		}
+
+		pm.patterns = append(pm.patterns, p)
+		pm.exclusions = pm.exclusions || p.exclusion
+	}
+
+	return pm, nil
+}
+
+// excluded reports whether rel, a slash separated path relative to the root,
+// is excluded.
+func (pm *patternMatcher) excluded(rel string) bool {
+	var matched bool
+
+	for _, p := range pm.patterns {
+		// only patterns which could change the verdict need to be evaluated.
+		if p.exclusion != matched {
+			continue
+		}
+
+		if p.match(rel) {
+			matched = !p.exclusion
+		}
+	}
+
+	return matched
+}
+
+// prune reports whether nothing beneath the excluded directory rel could be
+// re-included, so that it does not need to be walked.
+func (pm *patternMatcher) prune(rel string) bool {
+	if !pm.exclusions {
+		return true
+	}
+
+	dir := rel + "/"
+	for _, p := range pm.patterns {
+		if p.exclusion && (strings.HasPrefix(p.text+"/", dir) || strings.HasPrefix(p.text, "**")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readIgnoreFile reads patterns from a .dockerignore style file in fsys, one
+// per line, skipping blank lines and comments. A missing file has no
+// patterns.
+func readIgnoreFile(fsys fs.FS, name string) ([]string, error) {
+	content, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// packMatcher builds the matcher for the excludes in options, reading the
+// excludes file from fsys, or returns nil if nothing is excluded.
+func packMatcher(fsys fs.FS, options *Options) (*patternMatcher, error) {
+	if options == nil {
+		return nil, nil
+	}
+
+	patterns := options.Excludes
+
+	if options.ExcludesFile != "" {
+		filePatterns, err := readIgnoreFile(fsys, filepath.ToSlash(options.ExcludesFile))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading excludes file")
+		}
+		patterns = append(append([]string{}, patterns...), filePatterns...)
+	}
+
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	return newPatternMatcher(patterns)
+}
@@ -0,0 +1,133 @@
+package tarutil
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatternMatcher(t *testing.T) {
+	pm, err := newPatternMatcher([]string{
+		"*.log",
+		"/build",
+		"docs/**/*.md",
+		"!docs/keep/README.md",
+		"vendor",
+		"!vendor/keep",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		path     string
+		excluded bool
+	}{
+		{"app.log", true},
+		{"sub/app.log", false},
+		{"build", true},
+		{"build/out/bin", true},
+		{"docs/README.md", true},
+		{"docs/a/b/c.md", true},
+		{"docs/keep/README.md", false},
+		{"docs/a/b/c.txt", false},
+		{"vendor/pkg/a.go", true},
+		{"vendor/keep", false},
+		{"vendor/keep/a.go", false},
+		{"main.go", false},
+	}
+
+	for _, item := range table {
+		if excluded := pm.excluded(item.path); excluded != item.excluded {
+			t.Fatalf("%q: expected excluded to be %v, was %v", item.path, item.excluded, excluded)
+		}
+	}
+
+	if !pm.prune("build") {
+		t.Fatal("build could have been pruned")
+	}
+
+	if pm.prune("vendor") {
+		t.Fatal("vendor was pruned, but has re-included contents")
+	}
+
+	pm, err = newPatternMatcher([]string{`[\]]x`, "café/[é-ü]", "[^a]b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range []struct {
+		path     string
+		excluded bool
+	}{
+		{"]x", true},
+		{`\x`, false},
+		{"café/ö", true},
+		{"café/a", false},
+		{"cb", true},
+		{"ab", false},
+		{"/b", false},
+	} {
+		if excluded := pm.excluded(item.path); excluded != item.excluded {
+			t.Fatalf("%q: expected excluded to be %v, was %v", item.path, item.excluded, excluded)
+		}
+	}
+
+	if _, err := newPatternMatcher([]string{"[a-"}); err == nil {
+		t.Fatal("a bad pattern was accepted")
+	}
+}
+
+func TestPackExcludes(t *testing.T) {
+	packDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	for _, dir := range []string{"src", "node_modules/dep", "logs"} {
+		if err := os.MkdirAll(filepath.Join(packDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []string{"src/main.go", "src/main.go.orig", "node_modules/dep/index.js", "logs/a.log", "logs/keep.log"}
+	for _, name := range files {
+		if err := ioutil.WriteFile(filepath.Join(packDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignore := "# build context\nnode_modules\n**/*.orig\nlogs/*\n!logs/keep.log\n.dockerignore\n"
+	if err := ioutil.WriteFile(filepath.Join(packDir, ".dockerignore"), []byte(ignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// src/* is applied before the file's patterns, and nothing re-includes
+	// its contents.
+	options := &Options{ExcludesFile: ".dockerignore", Excludes: []string{"src/*"}}
+
+	buf := new(bytes.Buffer)
+	if err := PackWithOptions(context.Background(), packDir, buf, options); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := loopTarAndReturnHeaders(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"logs/", "logs/keep.log", "src/"}
+	if len(headers) != len(expected) {
+		t.Fatalf("expected %v headers, got %v", len(expected), len(headers))
+	}
+
+	for i, name := range expected {
+		if headers[i].Name != name {
+			t.Fatalf("expected %q, got %q", name, headers[i].Name)
+		}
+	}
+}
@@ -7,13 +7,16 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
-func prepHeader(p, linkName, rel string, hardLink bool, fi os.FileInfo) (*tar.Header, error) {
+func prepHeader(p, linkName, rel string, hardLink bool, fi os.FileInfo, options *Options) (*tar.Header, error) {
 	header, err := tar.FileInfoHeader(fi, linkName)
 	if err != nil {
 		return nil, err
@@ -22,6 +25,16 @@ func prepHeader(p, linkName, rel string, hardLink bool, fi os.FileInfo) (*tar.He
 	header.Linkname = linkName
 	header.Name = rel
 
+	if err := mapContainerIDs(header, options); err != nil {
+		return nil, err
+	}
+
+	if options != nil && options.Rootless {
+		if err := rootlessOwner(p, header); err != nil {
+			return nil, errors.Wrap(err, "reading rootless ownership")
+		}
+	}
+
 	// fixups to special files
 	if hardLink {
 		header.Typeflag = tar.TypeLink
@@ -32,116 +45,489 @@ func prepHeader(p, linkName, rel string, hardLink bool, fi os.FileInfo) (*tar.He
 		header.Name += "/"
 	}
 
-	// ripped directly from docker
-	capability, _ := Lgetxattr(p, "security.capability")
-	if capability != nil {
-		header.Xattrs = make(map[string]string)
-		header.Xattrs["security.capability"] = string(capability)
+	xattrs, err := packedXattrs(p, options)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading xattrs")
+	}
+	if len(xattrs) > 0 {
+		header.Xattrs = xattrs
+		header.Format = tar.FormatPAX
+		if err := packACLs(header, options); err != nil {
+			return nil, err
+		}
 	}
 
 	header.ChangeTime = time.Unix(fi.Sys().(*syscall.Stat_t).Ctim.Unix())
 	header.AccessTime = time.Unix(fi.Sys().(*syscall.Stat_t).Atim.Unix())
 	header.ModTime = time.Unix(fi.Sys().(*syscall.Stat_t).Mtim.Unix())
 
+	normalizeHeader(header, options)
+
 	return header, nil
 }
 
-func getLink(source, p string, fi os.FileInfo, inodeTable map[uint64]string) (string, bool, error) {
-	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
-		follow, err := os.Readlink(p)
+// normalizeHeader strips the parts of a header which vary between machines
+// and runs, as requested in options.
+func normalizeHeader(header *tar.Header, options *Options) {
+	if options == nil {
+		return
+	}
+
+	if options.Reproducible {
+		header.Format = tar.FormatPAX
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+	}
+
+	if !options.SourceDateEpoch.IsZero() && header.ModTime.After(options.SourceDateEpoch) {
+		header.ModTime = options.SourceDateEpoch
+	}
+
+	if options.NormalizeOwnership {
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+	}
+}
+
+func packXattr(name string, options *Options) bool {
+	if strings.HasPrefix(name, overlayXattrPrefix) {
+		return false
+	}
+
+	// in rootless mode the xattr becomes the ownership of the header.
+	if name == rootlessXattr && options != nil && options.Rootless {
+		return false
+	}
+
+	return xattrAllowed(name, options)
+}
+
+// packedXattrs reads the xattrs of p which the options allow to be packed.
+func packedXattrs(p string, options *Options) (map[string]string, error) {
+	names, err := Llistxattr(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var xattrs map[string]string
+	for _, name := range names {
+		if !packXattr(name, options) {
+			continue
+		}
+
+		value, err := Lgetxattr(p, name)
 		if err != nil {
-			return "", false, errors.Wrap(errInvalidSymlink, err.Error())
+			return nil, errors.Wrap(err, name)
+		}
+
+		// the xattr may have been removed since it was listed.
+		if value == nil {
+			continue
+		}
+
+		if xattrs == nil {
+			xattrs = map[string]string{}
 		}
+		xattrs[name] = string(value)
+	}
+
+	return xattrs, nil
+}
+
+// inodeKey identifies a file across all mounted file systems.
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// inodeTable maps the files with multiple links to the first path they were
+// packed as.
+type inodeTable map[inodeKey]string
 
-		var rel string
+// symlinkTarget returns the target to pack for the symlink p, according to
+// the symlink mode in the options.
+func symlinkTarget(source, p string, options *Options) (string, error) {
+	follow, err := os.Readlink(p)
+	if err != nil {
+		return "", err
+	}
+
+	var rel string
 
+	switch symlinkMode(options) {
+	case SymlinksVerbatim:
+		return follow, nil
+	case SymlinksRootRelative:
+		if !path.IsAbs(follow) {
+			return follow, nil
+		}
+
+		// resolve the target inside source, rather than on the host.
+		rel, err = filepath.Rel(path.Dir(p), filepath.Join(source, follow))
+	default:
 		// coerce the path to be a relative symlink.
 		if path.IsAbs(follow) {
 			rel, err = filepath.Rel(path.Dir(p), follow)
 		} else {
 			rel, err = filepath.Rel(path.Dir(p), path.Join(path.Dir(p), follow))
 		}
+	}
 
-		if err != nil {
-			return "", false, errors.Wrap(errInvalidSymlink, err.Error())
-		}
-		return rel, false, nil
+	if err != nil {
+		return "", errors.Wrap(ErrInvalidSymlink, err.Error())
+	}
+	return rel, nil
+}
+
+func getLink(source, p string, fi os.FileInfo, inodes inodeTable, options *Options) (string, bool, error) {
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		rel, err := symlinkTarget(source, p, options)
+		return rel, false, err
 	}
 
-	inode := fi.Sys().(*syscall.Stat_t).Ino
-	nlink := fi.Sys().(*syscall.Stat_t).Nlink
+	stat := fi.Sys().(*syscall.Stat_t)
 
-	if nlink > 1 {
-		// FIXME need to track across devices
-		if _, ok := inodeTable[inode]; ok {
-			return inodeTable[inode], true, nil
+	if stat.Nlink > 1 {
+		inode := inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+		if linkName, ok := inodes[inode]; ok {
+			return linkName, true, nil
 		}
 
 		rel, err := filepath.Rel(source, p)
 		if err != nil {
-			return "", false, errors.Wrap(errInvalidLink, err.Error())
+			return "", false, errors.Wrap(ErrInvalidLink, err.Error())
 		}
 
-		inodeTable[inode] = rel
+		inodes[inode] = rel
 		return "", false, nil
 	}
 
 	return "", false, nil
 }
 
-// Pack packs a tarball from the specified source, into the writer w. Returns
-// an error.
-func Pack(ctx context.Context, source string, w io.Writer) error {
-	inodeTable := map[uint64]string{}
+func writeOverlayWhiteout(tw *tarWriter, p string, header *tar.Header) error {
+	convertOverlayToWhiteout(header)
+	return newEntryError("write header", header, p, tw.WriteHeader(header))
+}
 
-	tw := tar.NewWriter(w)
-	defer tw.Close()
+func copyFile(ctx context.Context, tw *tarWriter, p string) error {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
 
-	err := filepath.Walk(source, func(p string, fi os.FileInfo, err error) error {
-		if p == source {
-			return nil
-		}
+	f, err := os.Open(abs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, &ctxReader{ctx: ctx, r: f})
+	return err
+}
+
+func packError(op, rel, p string, err error) error {
+	return newEntryError(op, &tar.Header{Name: rel}, p, err)
+}
+
+func writeOpaqueWhiteout(tw *tarWriter, p string, header *tar.Header) error {
+	opaque, err := Lgetxattr(p, overlayOpaqueXattr)
+	if err != nil {
+		return newEntryError("getxattr", header, p, err)
+	}
 
+	if string(opaque) != overlayOpaqueXattrValue {
+		return nil
+	}
+
+	opaqueHeader := opaqueWhiteoutHeader(header)
+	return newEntryError("write header", opaqueHeader, p, tw.WriteHeader(opaqueHeader))
+}
+
+func opaqueWhiteoutHeader(header *tar.Header) *tar.Header {
+	return &tar.Header{
+		Name:       filepath.Join(header.Name, whiteoutOpaqueDir),
+		Typeflag:   tar.TypeReg,
+		Mode:       header.Mode & int64(os.ModePerm),
+		Uid:        header.Uid,
+		Gid:        header.Gid,
+		Uname:      header.Uname,
+		Gname:      header.Gname,
+		ModTime:    header.ModTime,
+		AccessTime: header.AccessTime,
+		ChangeTime: header.ChangeTime,
+	}
+}
+
+func writeEntry(ctx context.Context, tw *tarWriter, source, p, rel string, fi os.FileInfo, inodes inodeTable, options *Options) error {
+	overlay := whiteoutMode(options) == WhiteoutsOverlay
+
+	if overlay && fi.Mode()&os.ModeCharDevice != 0 {
+		header, err := prepHeader(p, "", rel, false, fi, options)
 		if err != nil {
-			return err
+			return packError("header", rel, p, err)
 		}
 
-		rel, err := filepath.Rel(source, p)
-		if err != nil {
-			return err
+		// overlay may hard link whiteouts together, so they must be
+		// converted before they reach the inode table.
+		if isOverlayWhiteout(header) {
+			return writeOverlayWhiteout(tw, p, header)
 		}
+	}
 
-		linkName, hardLink, err := getLink(source, p, fi, inodeTable)
-		if err != nil {
+	linkName, hardLink, err := getLink(source, p, fi, inodes, options)
+	if err != nil {
+		return packError("readlink", rel, p, err)
+	}
+
+	header, err := prepHeader(p, linkName, rel, hardLink, fi, options)
+	if err != nil {
+		return packError("header", rel, p, err)
+	}
+
+	regular := !fi.IsDir() && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA)
+
+	if regular && options != nil && options.Sparse {
+		if written, err := writeSparse(ctx, tw, p, header, fi); err != nil || written {
+			return newEntryError("copy", header, p, err)
+		}
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return newEntryError("write header", header, p, err)
+	}
+
+	if overlay && fi.IsDir() {
+		return writeOpaqueWhiteout(tw, p, header)
+	}
+
+	if regular {
+		return newEntryError("copy", header, p, copyFile(ctx, tw, p))
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarWriter counts the entries written to a tar stream. w is the stream
+// itself, for writing headers archive/tar cannot.
+type tarWriter struct {
+	*tar.Writer
+	w       io.Writer
+	entries int
+}
+
+func (tw *tarWriter) WriteHeader(header *tar.Header) error {
+	if err := tw.Writer.WriteHeader(header); err != nil {
+		return err
+	}
+
+	tw.entries++
+	return nil
+}
+
+// abortWriter discards everything written to it once aborted, so that the
+// compressor of a failed pack can be closed without finishing its stream.
+type abortWriter struct {
+	w       io.Writer
+	aborted int32
+}
+
+func (a *abortWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&a.aborted) != 0 {
+		return len(p), nil
+	}
+	return a.w.Write(p)
+}
+
+// packWriter compresses a tar stream, computing its sizes on the way out,
+// and its digests if a result is wanted.
+type packWriter struct {
+	tw           *tarWriter
+	compressor   io.WriteCloser
+	sink         *abortWriter
+	counter      *countingWriter
+	uncompressed *countingWriter
+	diffID       digest.Digester
+	digest       digest.Digester
+}
+
+func newPackWriter(w io.Writer, options *Options, wantResult bool) (*packWriter, error) {
+	pw := &packWriter{}
+	if wantResult {
+		pw.diffID = digest.Canonical.Digester()
+		pw.digest = digest.Canonical.Digester()
+		w = io.MultiWriter(w, pw.digest.Hash())
+	}
+
+	pw.counter = &countingWriter{w: w}
+
+	pw.sink = &abortWriter{w: pw.counter}
+
+	compressor, err := Compress(pw.sink, options)
+	if err != nil {
+		return nil, err
+	}
+
+	pw.compressor = compressor
+	var uncompressed io.Writer = compressor
+	if wantResult {
+		uncompressed = io.MultiWriter(compressor, pw.diffID.Hash())
+	}
+	pw.uncompressed = &countingWriter{w: uncompressed}
+	pw.tw = &tarWriter{Writer: tar.NewWriter(pw.uncompressed), w: pw.uncompressed}
+
+	return pw, nil
+}
+
+// abort releases the compressor after a failure without writing the end of
+// the compressed stream, so that a truncated tar stream is not mistaken for a
+// complete one.
+func (pw *packWriter) abort() {
+	atomic.StoreInt32(&pw.sink.aborted, 1)
+	pw.compressor.Close()
+}
+
+// Close finishes the tar stream and flushes the compressor. The result is nil
+// unless it was wanted.
+func (pw *packWriter) Close() (*Result, error) {
+	if err := pw.tw.Close(); err != nil {
+		pw.abort()
+		return nil, err
+	}
+
+	if err := pw.compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	if pw.digest == nil {
+		return nil, nil
+	}
+
+	return &Result{
+		DiffID:           pw.diffID.Digest(),
+		Digest:           pw.digest.Digest(),
+		Size:             pw.counter.n,
+		UncompressedSize: pw.uncompressed.n,
+		Entries:          pw.tw.entries,
+	}, nil
+}
+
+// skipEntry reports whether the walk leaves out rel, returning
+// filepath.SkipDir if it should not descend into it either.
+func skipEntry(matcher *patternMatcher, rootDev uint64, p, rel string, fi os.FileInfo, options *Options) (bool, error) {
+	if matcher != nil && matcher.excluded(filepath.ToSlash(rel)) {
+		if fi.IsDir() && matcher.prune(filepath.ToSlash(rel)) {
+			return true, filepath.SkipDir
+		}
+		return true, nil
+	}
+
+	mode := mountMode(options)
+	if mode == MountsCross || uint64(fi.Sys().(*syscall.Stat_t).Dev) == rootDev {
+		return false, nil
+	}
+
+	if mode == MountsFail {
+		return true, packError("walk", rel, p, ErrMountPoint)
+	}
+
+	if fi.IsDir() {
+		return true, filepath.SkipDir
+	}
+
+	return true, nil
+}
+
+// Pack packs a tarball from the specified source, into the writer w, with
+// the default options. See PackWithOptions.
+func Pack(ctx context.Context, source string, w io.Writer) error {
+	return PackWithOptions(ctx, source, w, nil)
+}
+
+// PackWithOptions packs a tarball from the specified source, into the writer
+// w, according to the options. Entries are written in lexical order. With the
+// overlay whiteout mode, overlay whiteouts and opaque directories found in
+// source are written as AUFS whiteouts. Paths excluded by the Excludes and
+// ExcludesFile options are left out; excluded directories are not walked
+// unless a later pattern re-includes something beneath them. Mount points
+// below source are packed, skipped or fail the pack according to the Mounts
+// option.
+//
+// PackWithOptions stops when ctx is canceled, including in the middle of
+// copying a file, and returns an error wrapping ctx.Err(). The stream written
+// to w up to that point is not a complete tar archive, and if it is
+// compressed, the compressed stream is left unfinished too.
+func PackWithOptions(ctx context.Context, source string, w io.Writer, options *Options) error {
+	_, err := pack(ctx, source, w, options, false)
+	return err
+}
+
+// PackWithResult packs a tarball like PackWithOptions, and returns the digests and size
+// of what was written.
+func PackWithResult(ctx context.Context, source string, w io.Writer, options *Options) (*Result, error) {
+	return pack(ctx, source, w, options, true)
+}
+
+func pack(ctx context.Context, source string, w io.Writer, options *Options, wantResult bool) (*Result, error) {
+	inodes := inodeTable{}
+
+	matcher, err := packMatcher(os.DirFS(source), options)
+	if err != nil {
+		return nil, err
+	}
+
+	rootFi, err := os.Lstat(source)
+	if err != nil {
+		return nil, err
+	}
+	rootDev := uint64(rootFi.Sys().(*syscall.Stat_t).Dev)
+
+	pw, err := newPackWriter(w, options, wantResult)
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(source, func(p string, fi os.FileInfo, err error) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
-		header, err := prepHeader(p, linkName, rel, hardLink, fi)
+		if p == source {
+			return nil
+		}
+
+		rel, relErr := filepath.Rel(source, p)
+		if relErr != nil {
+			return relErr
+		}
+
 		if err != nil {
-			return err
+			return packError("walk", rel, p, err)
 		}
 
-		if err := tw.WriteHeader(header); err != nil {
+		if skip, err := skipEntry(matcher, rootDev, p, rel, fi, options); skip || err != nil {
 			return err
 		}
 
-		if !fi.IsDir() && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) {
-			abs, err := filepath.Abs(p)
-			if err != nil {
-				return err
-			}
-			f, err := os.Open(abs)
-			if err != nil {
-				return err
-			}
-			_, err = io.Copy(tw, f)
-			if err != nil {
-				return err
-			}
-			f.Close()
-		}
-		return nil
+		return writeEntry(ctx, pw.tw, source, p, rel, fi, inodes, options)
 	})
+	if err != nil {
+		pw.abort()
+		return nil, err
+	}
 
-	return err
+	return pw.Close()
 }
@@ -1,6 +1,8 @@
 package tarutil
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
@@ -11,7 +13,9 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -169,3 +173,379 @@ func walkUnpack(unpackDir string, files []string, count *int) func(string, os.Fi
 		return nil
 	}
 }
+
+func TestPackOverlayWhiteouts(t *testing.T) {
+	packDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	if err := syscall.Mknod(filepath.Join(packDir, "gone"), syscall.S_IFCHR, 0); err != nil {
+		t.Skipf("cannot create overlay whiteouts here: %v", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(packDir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Lsetxattr(filepath.Join(packDir, "dir"), overlayOpaqueXattr, []byte(overlayOpaqueXattrValue), 0); err != nil {
+		t.Skipf("cannot set overlay xattrs here: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(packDir, "dir", "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := PackWithOptions(context.Background(), packDir, buf, &Options{Whiteouts: WhiteoutsOverlay}); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := loopTarAndReturnHeaders(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name      string
+		entryType byte
+	}{
+		{"dir/", tar.TypeDir},
+		{"dir/" + whiteoutOpaqueDir, tar.TypeReg},
+		{"dir/a", tar.TypeReg},
+		{whiteoutPrefix + "gone", tar.TypeReg},
+	}
+
+	if len(headers) != len(expected) {
+		t.Fatalf("expected %v headers, got %v", len(expected), len(headers))
+	}
+
+	for i, item := range expected {
+		if headers[i].Name != item.name || headers[i].Typeflag != item.entryType {
+			t.Fatalf("expected %q (type %c), got %q (type %c)", item.name, item.entryType, headers[i].Name, headers[i].Typeflag)
+		}
+	}
+}
+
+func TestPackCompressed(t *testing.T) {
+	packDir, _, err := generateFiles(5, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	table := []*Options{
+		nil,
+		{Compression: Gzip},
+		{Compression: Gzip, CompressionLevel: 9, ParallelCompression: true},
+		{Compression: Zstd},
+		{Compression: Zstd, CompressionLevel: 19, ParallelCompression: true},
+	}
+
+	var diffID digest.Digest
+
+	for _, options := range table {
+		buf := new(bytes.Buffer)
+		result, err := PackWithResult(context.Background(), packDir, buf, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Digest != digest.FromBytes(buf.Bytes()) || result.Size != int64(buf.Len()) {
+			t.Fatalf("%+v: result does not describe the written stream", options)
+		}
+
+		dr, err := Decompress(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uncompressed, err := digest.FromReader(dr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr.Close()
+
+		if result.DiffID != uncompressed {
+			t.Fatalf("%+v: diffID %v does not match the uncompressed stream %v", options, result.DiffID, uncompressed)
+		}
+
+		if diffID != "" && result.DiffID != diffID {
+			t.Fatalf("%+v: diffID changed with compression", options)
+		}
+		diffID = result.DiffID
+	}
+
+	if err := PackWithOptions(context.Background(), packDir, ioutil.Discard, &Options{Compression: Bzip2}); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Fatalf("expected bzip2 to be unsupported, got %v", err)
+	}
+}
+
+func TestPackReproducible(t *testing.T) {
+	var (
+		epoch   = time.Unix(1500000000, 0)
+		options = &Options{Reproducible: true, SourceDateEpoch: epoch, NormalizeOwnership: true}
+		diffIDs []digest.Digest
+	)
+
+	for i := 0; i < 2; i++ {
+		packDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(packDir)
+
+		if err := os.Mkdir(filepath.Join(packDir, "dir"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"b", "a", "dir/c"} {
+			if err := ioutil.WriteFile(filepath.Join(packDir, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := os.Link(filepath.Join(packDir, "b"), filepath.Join(packDir, "dir/d")); err != nil {
+			t.Fatal(err)
+		}
+
+		// make the access times differ between the trees
+		atime := time.Now().Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(filepath.Join(packDir, "a"), atime, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		result, err := PackWithResult(context.Background(), packDir, buf, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffIDs = append(diffIDs, result.DiffID)
+
+		headers, err := loopTarAndReturnHeaders(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, header := range headers {
+			if !header.ModTime.Equal(epoch) || !header.AccessTime.IsZero() || !header.ChangeTime.IsZero() {
+				t.Fatalf("%q: times were not normalized: %v %v %v", header.Name, header.ModTime, header.AccessTime, header.ChangeTime)
+			}
+			if header.Uid != 0 || header.Gid != 0 || header.Uname != "" || header.Gname != "" {
+				t.Fatalf("%q: ownership was not normalized", header.Name)
+			}
+		}
+	}
+
+	if diffIDs[0] != diffIDs[1] {
+		t.Fatalf("identical trees packed to different streams: %v, %v", diffIDs[0], diffIDs[1])
+	}
+}
+
+func TestPackCancel(t *testing.T) {
+	packDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	f, err := os.Create(filepath.Join(packDir, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(8 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = Pack(ctx, packDir, &cancelingWriter{w: ioutil.Discard, n: 1 << 20, cancel: cancel})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the pack to be canceled, got %v", err)
+	}
+
+	if err := Pack(ctx, packDir, ioutil.Discard); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a canceled context to stop the pack, got %v", err)
+	}
+
+	// a canceled compressed pack must not look like a complete stream.
+	for _, c := range []Compression{Gzip, Zstd} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		buf := new(bytes.Buffer)
+		err = PackWithOptions(ctx, packDir, &cancelingWriter{w: buf, n: 0, cancel: cancel}, &Options{Compression: c})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%v: expected the pack to be canceled, got %v", c, err)
+		}
+
+		dr, err := Decompress(buf, &Options{Compression: c})
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, dr)
+			dr.Close()
+		}
+		if err == nil {
+			t.Fatalf("%v: the output of a canceled pack decompressed cleanly", c)
+		}
+	}
+}
+
+type statFileInfo struct {
+	os.FileInfo
+	stat *syscall.Stat_t
+}
+
+func (fi statFileInfo) Sys() interface{} {
+	return fi.stat
+}
+
+func TestPackLinksAcrossDevices(t *testing.T) {
+	fi, err := os.Lstat(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inodes := inodeTable{}
+	files := []struct {
+		name     string
+		dev      uint64
+		linkName string
+	}{
+		{"a", 1, ""},
+		{"b", 2, ""},
+		{"c", 1, "a"},
+		{"d", 2, "b"},
+	}
+
+	for _, file := range files {
+		stat := &syscall.Stat_t{Dev: file.dev, Ino: 42, Nlink: 2}
+		p := filepath.Join("/source", file.name)
+
+		linkName, hardLink, err := getLink("/source", p, statFileInfo{fi, stat}, inodes, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if linkName != file.linkName || hardLink != (file.linkName != "") {
+			t.Fatalf("%q: expected a link to %q, got %q", file.name, file.linkName, linkName)
+		}
+	}
+}
+
+func TestPackMounts(t *testing.T) {
+	fi, err := os.Lstat(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootDev := uint64(fi.Sys().(*syscall.Stat_t).Dev)
+	mount := statFileInfo{fi, &syscall.Stat_t{Dev: rootDev + 1}}
+
+	if skip, err := skipEntry(nil, rootDev, "/source/mnt", "mnt", mount, nil); skip || err != nil {
+		t.Fatalf("mount point was not crossed: %v %v", skip, err)
+	}
+
+	if skip, err := skipEntry(nil, rootDev, "/source/mnt", "mnt", mount, &Options{Mounts: MountsSkip}); !skip || err != filepath.SkipDir {
+		t.Fatalf("mount point was not skipped: %v %v", skip, err)
+	}
+
+	if _, err := skipEntry(nil, rootDev, "/source/mnt", "mnt", mount, &Options{Mounts: MountsFail}); !errors.Is(err, ErrMountPoint) {
+		t.Fatalf("expected a mount point error, got %v", err)
+	}
+
+	if skip, err := skipEntry(nil, rootDev, "/source/dir", "dir", fi, &Options{Mounts: MountsFail}); skip || err != nil {
+		t.Fatalf("directory on the same file system was skipped: %v %v", skip, err)
+	}
+}
+
+func TestPackSymlinkModes(t *testing.T) {
+	packDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	if err := os.Mkdir(filepath.Join(packDir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("/usr/share/zoneinfo/UTC", filepath.Join(packDir, "etc/localtime")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("../usr/./lib", filepath.Join(packDir, "etc/lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	hostRelative, err := filepath.Rel(filepath.Join(packDir, "etc"), "/usr/share/zoneinfo/UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		mode      SymlinkMode
+		localtime string
+		lib       string
+	}{
+		{SymlinksRelative, hostRelative, "../usr/lib"},
+		{SymlinksVerbatim, "/usr/share/zoneinfo/UTC", "../usr/./lib"},
+		{SymlinksRootRelative, "../usr/share/zoneinfo/UTC", "../usr/./lib"},
+	}
+
+	for _, item := range table {
+		buf := new(bytes.Buffer)
+		if err := PackWithOptions(context.Background(), packDir, buf, &Options{Symlinks: item.mode}); err != nil {
+			t.Fatal(err)
+		}
+
+		headers, err := loopTarAndReturnHeaders(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(headers) != 3 {
+			t.Fatalf("expected 3 headers, got %d", len(headers))
+		}
+
+		if headers[1].Name != "etc/lib" || headers[1].Linkname != item.lib {
+			t.Fatalf("mode %d: expected etc/lib to point at %q, got %q", item.mode, item.lib, headers[1].Linkname)
+		}
+
+		if headers[2].Name != "etc/localtime" || headers[2].Linkname != item.localtime {
+			t.Fatalf("mode %d: expected etc/localtime to point at %q, got %q", item.mode, item.localtime, headers[2].Linkname)
+		}
+	}
+}
+
+func TestPackWalkError(t *testing.T) {
+	if os.Geteuid() == 0 {
+		runUnprivileged(t, "TestPackWalkError")
+		return
+	}
+
+	packDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	locked := filepath.Join(packDir, "locked")
+	if err := os.Mkdir(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0700)
+
+	err = Pack(context.Background(), packDir, ioutil.Discard)
+
+	var entryErr *EntryError
+	if !errors.As(err, &entryErr) {
+		t.Fatalf("expected an *EntryError, got %v", err)
+	}
+
+	if entryErr.Op != "walk" || entryErr.Name != "locked" || entryErr.Path != locked {
+		t.Fatalf("unexpected error details: %#v", entryErr)
+	}
+}
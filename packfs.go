@@ -0,0 +1,386 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// readLinkFS is implemented by file systems which can read symlinks, such as
+// the fs.ReadLinkFS of newer Go releases.
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+}
+
+// fsHeader prepares the header of an entry read from an fs.FS or given in a
+// manifest. Times keep the precision of the file system, as they do in Pack.
+func fsHeader(fi fs.FileInfo, name, linkName string, options *Options) (*tar.Header, error) {
+	header, err := tar.FileInfoHeader(fi, linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	header.Name = name
+	if fi.IsDir() && name[len(name)-1] != '/' {
+		header.Name += "/"
+	}
+
+	if err := mapContainerIDs(header, options); err != nil {
+		return nil, err
+	}
+
+	normalizeHeader(header, options)
+	return header, nil
+}
+
+func writeFSEntry(ctx context.Context, tw *tarWriter, fsys fs.FS, name string, d fs.DirEntry, options *Options) error {
+	fi, err := d.Info()
+	if err != nil {
+		return packError("stat", name, name, err)
+	}
+
+	var linkName string
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		rl, ok := fsys.(readLinkFS)
+		if !ok {
+			return packError("readlink", name, name, errors.Wrap(ErrInvalidSymlink, "file system cannot read symlinks"))
+		}
+
+		if linkName, err = rl.ReadLink(name); err != nil {
+			return packError("readlink", name, name, err)
+		}
+	}
+
+	header, err := fsHeader(fi, name, linkName, options)
+	if err != nil {
+		return packError("header", name, name, err)
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return newEntryError("write header", header, name, err)
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return newEntryError("open", header, name, err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, &ctxReader{ctx: ctx, r: f})
+	return newEntryError("copy", header, name, err)
+}
+
+// PackFS packs a tarball from the file system fsys, into the writer w, like
+// Pack does for a directory. Entries are written in lexical order, and the
+// excludes file is read from fsys. Symlinks can only be packed if fsys
+// implements a ReadLink method. Options which rely on the file system being
+// on disk, such as the whiteout, xattr, sparse, mount and symlink options,
+// have no effect; symlink targets are packed verbatim.
+func PackFS(ctx context.Context, fsys fs.FS, w io.Writer, options *Options) error {
+	_, err := packFS(ctx, fsys, w, options, false)
+	return err
+}
+
+// PackFSWithResult packs a tarball like PackFS, and returns the digests and
+// size of what was written like PackWithResult does.
+func PackFSWithResult(ctx context.Context, fsys fs.FS, w io.Writer, options *Options) (*Result, error) {
+	return packFS(ctx, fsys, w, options, true)
+}
+
+func packFS(ctx context.Context, fsys fs.FS, w io.Writer, options *Options, wantResult bool) (*Result, error) {
+	matcher, err := packMatcher(fsys, options)
+	if err != nil {
+		return nil, err
+	}
+
+	pw, err := newPackWriter(w, options, wantResult)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err != nil {
+			return packError("walk", name, name, err)
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		if matcher != nil && matcher.excluded(name) {
+			if d.IsDir() && matcher.prune(name) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		return writeFSEntry(ctx, pw.tw, fsys, name, d, options)
+	})
+	if err != nil {
+		pw.abort()
+		return nil, err
+	}
+
+	return pw.Close()
+}
+
+// HeaderFields selects fields of a tar header.
+type HeaderFields uint
+
+const (
+	// FieldMode selects the mode.
+	FieldMode HeaderFields = 1 << iota
+	// FieldUID selects the user ID. Unless FieldUname is selected too, the
+	// user name is cleared when it is overridden.
+	FieldUID
+	// FieldGID selects the group ID. Unless FieldGname is selected too, the
+	// group name is cleared when it is overridden.
+	FieldGID
+	// FieldUname selects the user name.
+	FieldUname
+	// FieldGname selects the group name.
+	FieldGname
+	// FieldModTime selects the modification time.
+	FieldModTime
+	// FieldXattrs selects the xattrs; overriding them with nil clears them.
+	FieldXattrs
+	// FieldPAXRecords selects the PAX records.
+	FieldPAXRecords
+)
+
+// ManifestEntry describes an entry of a tarball written by PackManifest.
+type ManifestEntry struct {
+	// Path is the name of the entry in the tarball.
+	Path string
+	// Source is a file on disk to pack the entry from, as Pack would.
+	Source string
+	// Reader supplies the contents of a regular file if there is no Source.
+	// If Header does not give the size, the contents are read into memory
+	// to find it.
+	Reader io.Reader
+	// Header describes an entry without a Source; a regular file with mode
+	// 0644 is written if it is nil. For an entry with a Source, it holds the
+	// values of the fields selected by Override.
+	Header *tar.Header
+	// Override selects the fields of Header which replace those read from
+	// the Source, even if they are zero; they are all zero if Header is nil.
+	Override HeaderFields
+}
+
+// overrideHeader replaces the fields of header selected by fields with those
+// of overrides, which are all zero if overrides is nil.
+func overrideHeader(header, overrides *tar.Header, fields HeaderFields) {
+	if overrides == nil {
+		overrides = &tar.Header{}
+	}
+
+	if fields&FieldMode != 0 {
+		header.Mode = overrides.Mode
+	}
+	if fields&FieldUID != 0 {
+		header.Uid = overrides.Uid
+		header.Uname = ""
+	}
+	if fields&FieldGID != 0 {
+		header.Gid = overrides.Gid
+		header.Gname = ""
+	}
+	if fields&FieldUname != 0 {
+		header.Uname = overrides.Uname
+	}
+	if fields&FieldGname != 0 {
+		header.Gname = overrides.Gname
+	}
+	if fields&FieldModTime != 0 {
+		header.ModTime = overrides.ModTime
+	}
+	if fields&FieldXattrs != 0 {
+		header.Xattrs = overrides.Xattrs
+	}
+	if fields&FieldPAXRecords != 0 {
+		header.PAXRecords = overrides.PAXRecords
+	}
+	if len(header.Xattrs) > 0 || len(header.PAXRecords) > 0 {
+		header.Format = tar.FormatPAX
+	}
+}
+
+// sourceHeader prepares the header of a manifest entry packed from a file on
+// disk. Files with multiple links are written as hard links to the first
+// entry packed from them.
+func sourceHeader(entry ManifestEntry, fi os.FileInfo, inodes inodeTable, options *Options) (*tar.Header, error) {
+	var linkName string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(entry.Source)
+		if err != nil {
+			return nil, err
+		}
+		linkName = target
+	}
+
+	header, err := fsHeader(fi, entry.Path, linkName, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if xattrs, err := packedXattrs(entry.Source, options); err != nil {
+		return nil, errors.Wrap(err, "reading xattrs")
+	} else if len(xattrs) > 0 {
+		header.Xattrs = xattrs
+		header.Format = tar.FormatPAX
+		if err := packACLs(header, options); err != nil {
+			return nil, err
+		}
+	}
+
+	stat := fi.Sys().(*syscall.Stat_t)
+	if fi.Mode().IsRegular() && stat.Nlink > 1 {
+		inode := inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+		if linkName, ok := inodes[inode]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = linkName
+			header.Size = 0
+		} else {
+			inodes[inode] = entry.Path
+		}
+	}
+
+	overrideHeader(header, entry.Header, entry.Override)
+	return header, nil
+}
+
+// readerHeader prepares the header of a manifest entry without a source,
+// reading its contents into memory if the size is unknown.
+func readerHeader(entry ManifestEntry) (*tar.Header, io.Reader, error) {
+	header := &tar.Header{Typeflag: tar.TypeReg, Mode: 0644}
+	if entry.Header != nil {
+		h := *entry.Header
+		header = &h
+	}
+	header.Name = entry.Path
+
+	if header.Typeflag == tar.TypeRegA {
+		header.Typeflag = tar.TypeReg
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return header, nil, nil
+	}
+
+	r := entry.Reader
+	if r == nil {
+		r = bytes.NewReader(nil)
+	}
+
+	if header.Size == 0 {
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Size = int64(len(content))
+		r = bytes.NewReader(content)
+	}
+
+	return header, r, nil
+}
+
+func writeManifestEntry(ctx context.Context, tw *tarWriter, entry ManifestEntry, inodes inodeTable, options *Options) error {
+	var (
+		header *tar.Header
+		r      io.Reader
+	)
+
+	if entry.Path == "" {
+		return packError("header", entry.Path, entry.Source, errors.New("manifest entry has no path"))
+	}
+
+	if entry.Source != "" {
+		fi, err := os.Lstat(entry.Source)
+		if err != nil {
+			return packError("stat", entry.Path, entry.Source, err)
+		}
+
+		if header, err = sourceHeader(entry, fi, inodes, options); err != nil {
+			return packError("header", entry.Path, entry.Source, err)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			f, err := os.Open(entry.Source)
+			if err != nil {
+				return newEntryError("open", header, entry.Source, err)
+			}
+			defer f.Close()
+			r = f
+		}
+	} else {
+		var err error
+		if header, r, err = readerHeader(entry); err != nil {
+			return packError("read", entry.Path, "", err)
+		}
+		normalizeHeader(header, options)
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return newEntryError("write header", header, entry.Source, err)
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	_, err := io.Copy(tw, &ctxReader{ctx: ctx, r: r})
+	return newEntryError("copy", header, entry.Source, err)
+}
+
+// PackManifest packs a tarball of the entries listed in the manifest, in the
+// order they are listed, into the writer w. Directories are not walked; each
+// entry is written on its own. Entries are not beneath a common root, so the
+// Symlinks option does not apply and symlink targets are packed verbatim.
+func PackManifest(ctx context.Context, manifest []ManifestEntry, w io.Writer, options *Options) error {
+	_, err := packManifest(ctx, manifest, w, options, false)
+	return err
+}
+
+// PackManifestWithResult packs a tarball like PackManifest, and returns the
+// digests and size of what was written like PackWithResult does.
+func PackManifestWithResult(ctx context.Context, manifest []ManifestEntry, w io.Writer, options *Options) (*Result, error) {
+	return packManifest(ctx, manifest, w, options, true)
+}
+
+func packManifest(ctx context.Context, manifest []ManifestEntry, w io.Writer, options *Options, wantResult bool) (*Result, error) {
+	inodes := inodeTable{}
+
+	pw, err := newPackWriter(w, options, wantResult)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range manifest {
+		if err := ctx.Err(); err != nil {
+			pw.abort()
+			return nil, err
+		}
+
+		if err := writeManifestEntry(ctx, pw.tw, entry, inodes, options); err != nil {
+			pw.abort()
+			return nil, err
+		}
+	}
+
+	return pw.Close()
+}
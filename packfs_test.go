@@ -0,0 +1,150 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestPackFS(t *testing.T) {
+	modTime := time.Unix(1500000000, 0)
+
+	fsys := fstest.MapFS{
+		"etc/hosts":       {Data: []byte("127.0.0.1 localhost\n"), Mode: 0644, ModTime: modTime},
+		"bin/app":         {Data: []byte("binary"), Mode: 0755, ModTime: modTime},
+		"bin/app.debug":   {Data: []byte("symbols"), Mode: 0644, ModTime: modTime},
+		".dockerignore":   {Data: []byte("*/*.debug\n.dockerignore\n"), Mode: 0644, ModTime: modTime},
+		"var/empty/.keep": {Mode: 0600, ModTime: modTime},
+	}
+
+	buf := new(bytes.Buffer)
+	result, err := PackFSWithResult(context.Background(), fsys, buf, &Options{ExcludesFile: ".dockerignore", NormalizeOwnership: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := loopTarAndReturnHeaders(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name string
+		mode int64
+		size int64
+	}{
+		{"bin/", 0555, 0},
+		{"bin/app", 0755, 6},
+		{"etc/", 0555, 0},
+		{"etc/hosts", 0644, 20},
+		{"var/", 0555, 0},
+		{"var/empty/", 0555, 0},
+		{"var/empty/.keep", 0600, 0},
+	}
+
+	if len(headers) != len(expected) || result.Entries != len(expected) {
+		t.Fatalf("expected %d headers, got %d", len(expected), len(headers))
+	}
+
+	for i, item := range expected {
+		header := headers[i]
+		if header.Name != item.name || header.Mode != item.mode || header.Size != item.size {
+			t.Fatalf("expected %+v, got %q mode %o size %d", item, header.Name, header.Mode, header.Size)
+		}
+	}
+}
+
+func TestPackManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("from disk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Link(source, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := []ManifestEntry{
+		{Path: "etc/", Header: &tar.Header{Typeflag: tar.TypeDir, Mode: 0755}},
+		{Path: "etc/ssl/certs.pem", Reader: strings.NewReader("generated")},
+		{Path: "etc/source", Source: source, Header: &tar.Header{Mode: 0640, Uid: 1000, Gid: 1000}, Override: FieldMode | FieldUID | FieldGID},
+		{Path: "etc/link", Source: filepath.Join(dir, "link")},
+		{Path: "etc/localtime", Header: &tar.Header{Typeflag: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC"}},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := PackManifest(context.Background(), manifest, buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(buf)
+	contents := map[string]string{}
+	headers := map[string]*tar.Header{}
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headers[header.Name] = header
+		contents[header.Name] = string(content)
+	}
+
+	if len(headers) != len(manifest) {
+		t.Fatalf("expected %d entries, got %d", len(manifest), len(headers))
+	}
+
+	if contents["etc/ssl/certs.pem"] != "generated" || headers["etc/ssl/certs.pem"].Mode != 0644 {
+		t.Fatal("entry from a reader was not packed")
+	}
+
+	if h := headers["etc/source"]; contents["etc/source"] != "from disk" || h.Mode != 0640 || h.Uid != 1000 {
+		t.Fatalf("entry from a source was not packed with its overrides: %+v", h)
+	}
+
+	if h := headers["etc/link"]; h.Typeflag != tar.TypeLink || h.Linkname != "etc/source" {
+		t.Fatalf("second link to a source was not packed as a hard link: %+v", h)
+	}
+
+	if h := headers["etc/localtime"]; h.Typeflag != tar.TypeSymlink || h.Linkname != "/usr/share/zoneinfo/UTC" {
+		t.Fatalf("symlink was not packed: %+v", h)
+	}
+}
+
+func TestOverrideHeader(t *testing.T) {
+	header := &tar.Header{Uid: 10, Gid: 20, Uname: "user", Gname: "group", Mode: 0644}
+
+	overrideHeader(header, &tar.Header{Uid: 1000, Gname: "staff"}, FieldUID|FieldGname)
+	if header.Uid != 1000 || header.Gid != 20 || header.Uname != "" || header.Gname != "staff" || header.Mode != 0644 {
+		t.Fatalf("unexpected header after overriding the uid and group name: %+v", header)
+	}
+
+	overrideHeader(header, &tar.Header{Gid: 50}, FieldGID)
+	if header.Uid != 1000 || header.Gid != 50 || header.Gname != "" {
+		t.Fatalf("unexpected ownership after overriding the gid: %+v", header)
+	}
+
+	header.Xattrs = map[string]string{"user.foo": "bar"}
+	overrideHeader(header, &tar.Header{Uname: "root", Gname: "root"}, FieldUID|FieldGID|FieldUname|FieldGname|FieldMode|FieldXattrs)
+	if header.Uid != 0 || header.Gid != 0 || header.Uname != "root" || header.Gname != "root" || header.Mode != 0 || header.Xattrs != nil {
+		t.Fatalf("unexpected header after overriding to root: %+v", header)
+	}
+}
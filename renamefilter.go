@@ -0,0 +1,160 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RenameFilter is a TarFilter which relocates entries by renaming them. Names
+// are renamed without leading slashes and "./" prefixes. The names of hard
+// link targets are renamed along with the entries, so links keep pointing at
+// the same file; symlink targets are left alone. Entries whose name, or hard
+// link target, becomes empty are dropped.
+type RenameFilter struct {
+	rename  func(name string) string
+	parents []string
+	written map[string]bool
+	tw      *tar.Writer
+}
+
+// NewStripComponents creates a filter removing the first n components of
+// names, like tar --strip-components.
+func NewStripComponents(n int) *RenameFilter {
+	return &RenameFilter{rename: func(name string) string {
+		if n <= 0 {
+			return name
+		}
+
+		parts := strings.SplitN(name, "/", n+1)
+		if len(parts) <= n {
+			return ""
+		}
+		return parts[n]
+	}}
+}
+
+// NewAddPrefix creates a filter moving entries beneath the directory prefix.
+// Entries for the directories of the prefix are written before the first
+// entry, with mode 0755 and its modification time, unless the first entry is
+// one of them. Later entries of the stream for these directories are dropped.
+func NewAddPrefix(prefix string) *RenameFilter {
+	r := &RenameFilter{
+		rename: func(name string) string {
+			return path.Join(prefix, name)
+		},
+		written: map[string]bool{},
+	}
+
+	if prefix = cleanEntryName(prefix); prefix != "" {
+		parts := strings.Split(prefix, "/")
+		for i := range parts {
+			r.parents = append(r.parents, strings.Join(parts[:i+1], "/")+"/")
+		}
+	}
+
+	return r
+}
+
+// NewTransform creates a filter replacing the first match of the regular
+// expression pattern in names with replacement, like tar --transform does
+// without the g flag. The replacement can refer to submatches as described by
+// regexp.Regexp.Expand.
+func NewTransform(pattern, replacement string) (*RenameFilter, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "transform %q", pattern)
+	}
+
+	return &RenameFilter{rename: func(name string) string {
+		match := re.FindStringSubmatchIndex(name)
+		if match == nil {
+			return name
+		}
+		return name[:match[0]] + string(re.ExpandString(nil, replacement, name, match)) + name[match[1]:]
+	}}, nil
+}
+
+// SetTarWriter sets the tar writer for output processing.
+func (r *RenameFilter) SetTarWriter(tw *tar.Writer) error {
+	if r.tw == nil {
+		r.tw = tw
+		return nil
+	}
+	return fmt.Errorf("the TarWriter is already set")
+}
+
+// Close closes the tar filter, finalizing any processing.
+func (r *RenameFilter) Close() error {
+	return r.tw.Close()
+}
+
+// renamed returns the new name for name, keeping a trailing slash, or false if
+// it has become empty.
+func (r *RenameFilter) renamed(name string) (string, bool) {
+	dir := strings.HasSuffix(name, "/")
+
+	name = cleanEntryName(r.rename(cleanEntryName(name)))
+	if name == "" {
+		return "", false
+	}
+
+	if dir {
+		name += "/"
+	}
+	return name, true
+}
+
+// writeParents writes the entries for the directories of the prefix which
+// are not the entry h itself.
+func (r *RenameFilter) writeParents(h *tar.Header) error {
+	for _, dir := range r.parents {
+		r.written[dir] = true
+		if dir == h.Name {
+			continue
+		}
+
+		header := &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755, ModTime: h.ModTime}
+		if err := r.tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+	r.parents = nil
+
+	return nil
+}
+
+// HandleEntry renames the entry, and the target of hard links.
+func (r *RenameFilter) HandleEntry(h *tar.Header) (bool, bool, error) {
+	if r.tw == nil {
+		return false, false, fmt.Errorf("the tarWriter isn't set")
+	}
+
+	name, ok := r.renamed(h.Name)
+	if !ok {
+		return false, false, nil
+	}
+
+	if h.Typeflag == tar.TypeLink {
+		linkName, ok := r.renamed(h.Linkname)
+		if !ok {
+			return false, false, nil
+		}
+		h.Linkname = linkName
+	}
+
+	if r.written[name] {
+		return false, false, nil
+	}
+
+	h.Name = name
+	if err := r.writeParents(h); err != nil {
+		return false, false, err
+	}
+
+	return true, true, nil
+}
@@ -0,0 +1,131 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func renameTar(t *testing.T, f TarFilter, headers []tar.Header) []*tar.Header {
+	fr, err := FilterTarUsingFilter(generateTarFromHeaders(headers), f)
+	if err != nil {
+		t.Fatalf("failed to instantiate filter: %v", err)
+	}
+
+	renamed, err := loopTarAndReturnHeaders(fr)
+	if err != nil {
+		t.Fatalf("failed to iterate through the items: %v", err)
+	}
+
+	if err := fr.Wait(); err != nil {
+		t.Fatalf("filtering failed: %v", err)
+	}
+
+	return renamed
+}
+
+func checkNames(t *testing.T, headers []*tar.Header, items [][2]string) {
+	if len(headers) != len(items) {
+		t.Fatalf("expected %v headers, got %v", len(items), len(headers))
+	}
+
+	for i, item := range items {
+		if headers[i].Name != item[0] || headers[i].Linkname != item[1] {
+			t.Fatalf("expected %v -> %q, got %v -> %q", item[0], item[1], headers[i].Name, headers[i].Linkname)
+		}
+	}
+}
+
+func TestStripComponentsAndPrefix(t *testing.T) {
+	headers := []tar.Header{
+		{Name: "README", Typeflag: tar.TypeReg},
+		{Name: "app-1.0/", Typeflag: tar.TypeDir},
+		{Name: "app-1.0/bin/", Typeflag: tar.TypeDir},
+		{Name: "./app-1.0/bin/app", Typeflag: tar.TypeReg},
+		{Name: "app-1.0/bin/app-link", Linkname: "app-1.0/bin/app", Typeflag: tar.TypeLink},
+		{Name: "app-1.0/lib", Linkname: "/usr/lib", Typeflag: tar.TypeSymlink},
+		{Name: "app-1.0/README", Linkname: "README", Typeflag: tar.TypeLink},
+	}
+
+	renamed := renameTar(t, Chain(NewStripComponents(1), NewAddPrefix("/opt/app")), headers)
+	checkNames(t, renamed, [][2]string{
+		{"opt/", ""},
+		{"opt/app/", ""},
+		{"opt/app/bin/", ""},
+		{"opt/app/bin/app", ""},
+		{"opt/app/bin/app-link", "opt/app/bin/app"},
+		{"opt/app/lib", "/usr/lib"},
+	})
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fr, err := FilterTarUsingFilter(generateTarFromHeaders(headers), Chain(NewStripComponents(1), NewAddPrefix("/opt/app")))
+	if err != nil {
+		t.Fatalf("failed to instantiate filter: %v", err)
+	}
+
+	if err := Unpack(context.Background(), fr, dir, &Options{NoLchown: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Lstat(filepath.Join(dir, "opt/app/bin/app")); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("opt/app/bin/app was not unpacked: %v", err)
+	}
+}
+
+func TestAddPrefixRoot(t *testing.T) {
+	headers := []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "./bin/", Typeflag: tar.TypeDir},
+		{Name: "opt/", Typeflag: tar.TypeDir},
+	}
+
+	renamed := renameTar(t, NewAddPrefix("opt/app"), headers)
+	checkNames(t, renamed, [][2]string{
+		{"opt/", ""},
+		{"opt/app/", ""},
+		{"opt/app/bin/", ""},
+		{"opt/app/opt/", ""},
+	})
+
+	if renamed[1].Mode != 0700 {
+		t.Fatalf("the ./ entry was replaced: mode %o", renamed[1].Mode)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	headers := []tar.Header{
+		{Name: "app-1.0/", Typeflag: tar.TypeDir},
+		{Name: "app-1.0/doc.txt", Typeflag: tar.TypeReg},
+		{Name: "app-1.0/notes.txt", Linkname: "app-1.0/doc.txt", Typeflag: tar.TypeLink},
+		{Name: "other/app-1.0", Typeflag: tar.TypeReg},
+	}
+
+	f, err := NewTransform(`^app-[0-9.]+`, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewTransform(`([^/]*)\.txt$`, "${1}.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := renameTar(t, Chain(f, g), headers)
+	checkNames(t, renamed, [][2]string{
+		{"app/", ""},
+		{"app/doc.md", ""},
+		{"app/notes.md", "app/doc.md"},
+		{"other/app-1.0", ""},
+	})
+
+	if _, err := NewTransform("(", ""); err == nil {
+		t.Fatal("an invalid pattern did not fail")
+	}
+}
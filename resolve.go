@@ -0,0 +1,192 @@
+package tarutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// These are not currently available in syscall
+const (
+	sysOpenat2          = 437
+	oPath               = 0x200000
+	resolveNoMagiclinks = 0x02
+	resolveBeneath      = 0x08
+	maxSymlinks         = 40
+)
+
+// TraversalError is returned when a tar entry would be written outside of
+// the destination directory, either through its name or through a symlink
+// unpacked earlier.
+type TraversalError struct {
+	Name string
+	Root string
+}
+
+func (e *TraversalError) Error() string {
+	return fmt.Sprintf("tar entry %q resolves outside of %q", e.Name, e.Root)
+}
+
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+func openat2(dirfd int, path string, how *openHow) (int, error) {
+	_path, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+
+	for {
+		fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(_path)), uintptr(unsafe.Pointer(how)), unsafe.Sizeof(*how), 0, 0)
+		if errno == syscall.EINTR || errno == syscall.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			return -1, errno
+		}
+		return int(fd), nil
+	}
+}
+
+// resolver maps tar entry names to paths beneath a root directory. The parent
+// directories of an entry are resolved with openat2(2) and RESOLVE_BENEATH, or
+// an equivalent walk in Go on kernels without it; the final component is never
+// followed.
+//
+// The parents are checked once per entry, and the entry is then created,
+// chowned, chmodded and timestamped through the path returned; whiteouts are
+// resolved to the path they remove. This protects against the symlinks of the
+// archive itself, whose entries are unpacked one at a time, but not against
+// another process swapping a parent directory for a symlink between the check
+// and the use; the destination must not be writable by anyone else while
+// unpacking.
+type resolver struct {
+	root     string
+	rootFd   int
+	fallback bool
+}
+
+func newResolver(root string) (*resolver, error) {
+	fd, err := syscall.Open(root, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+
+	return &resolver{root: filepath.Clean(root), rootFd: fd}, nil
+}
+
+func (r *resolver) Close() error {
+	return syscall.Close(r.rootFd)
+}
+
+func isBeneath(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// resolve returns the path name should be created at. If resolving its
+// parent fails, the path is returned along with the error.
+func (r *resolver) resolve(name string) (string, error) {
+	rel := filepath.Clean(strings.TrimLeft(name, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", &TraversalError{Name: name, Root: r.root}
+	}
+
+	parent := filepath.Dir(rel)
+	if parent != "." {
+		escapes, err := r.escapes(parent)
+		if err != nil {
+			return filepath.Join(r.root, rel), err
+		}
+		if escapes {
+			return "", &TraversalError{Name: name, Root: r.root}
+		}
+	}
+
+	return filepath.Join(r.root, rel), nil
+}
+
+// escapes returns true if resolving the relative directory parent leaves the
+// root. Failing to resolve it for any other reason, including a missing
+// directory, is an error.
+func (r *resolver) escapes(parent string) (bool, error) {
+	if !r.fallback {
+		fd, err := openat2(r.rootFd, parent, &openHow{
+			flags:   oPath | syscall.O_DIRECTORY | syscall.O_CLOEXEC,
+			resolve: resolveBeneath | resolveNoMagiclinks,
+		})
+		switch err {
+		case nil:
+			return false, syscall.Close(fd)
+		case syscall.EXDEV:
+			return true, nil
+		case syscall.ENOSYS, syscall.EPERM, syscall.EINVAL, syscall.E2BIG:
+			r.fallback = true
+		default:
+			return false, &os.PathError{Op: "openat2", Path: filepath.Join(r.root, parent), Err: err}
+		}
+	}
+
+	return r.walkEscapes(parent)
+}
+
+// walkEscapes mirrors RESOLVE_BENEATH: relative symlinks are followed as long
+// as they stay beneath the root, and absolute symlinks are rejected.
+func (r *resolver) walkEscapes(parent string) (bool, error) {
+	var (
+		resolved []string
+		todo     = strings.Split(parent, "/")
+		links    int
+	)
+
+	for len(todo) > 0 {
+		component := todo[0]
+		todo = todo[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return true, nil
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		current := filepath.Join(r.root, filepath.Join(resolved...), component)
+		fi, err := os.Lstat(current)
+		if err != nil {
+			return false, err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, component)
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return false, &os.PathError{Op: "resolve", Path: current, Err: syscall.ELOOP}
+		}
+
+		target, err := os.Readlink(current)
+		if err != nil {
+			return false, err
+		}
+
+		if filepath.IsAbs(target) {
+			return true, nil
+		}
+
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+
+	return false, nil
+}
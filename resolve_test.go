@@ -0,0 +1,148 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestResolveBeneath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "usr/lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"lib":      "usr/lib",
+		"abs":      "/usr/lib",
+		"up":       "usr/../..",
+		"loop":     "loop",
+		"sneaky":   "usr/lib/../../up",
+		"inside":   "usr/lib/..",
+		"dangling": "missing",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := []struct {
+		name   string
+		escape bool
+	}{
+		{"foo", false},
+		{"/foo", false},
+		{"usr/lib/foo", false},
+		{"lib/foo", false},
+		{"inside/lib/foo", false},
+		{"dangling/foo", false},
+		{"../foo", true},
+		{"usr/../../foo", true},
+		{"abs/foo", true},
+		{"up/foo", true},
+		{"sneaky/foo", true},
+	}
+
+	for _, fallback := range []bool{false, true} {
+		res, err := newResolver(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.fallback = fallback
+
+		for _, item := range table {
+			_, err := res.resolve(item.name)
+			_, escaped := err.(*TraversalError)
+			if escaped != item.escape {
+				t.Fatalf("fallback %v: %q: expected escape %v, got error %v", fallback, item.name, item.escape, err)
+			}
+		}
+
+		if _, err := res.resolve("loop/foo"); err == nil {
+			t.Fatalf("fallback %v: resolved a symlink loop", fallback)
+		}
+
+		res.Close()
+	}
+}
+
+func TestUntarPathTraversal(t *testing.T) {
+	base, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	dir := filepath.Join(base, "dest")
+
+	layers := [][]tar.Header{
+		{
+			{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		{
+			{Name: "root", Typeflag: tar.TypeSymlink, Linkname: "/"},
+			{Name: "root/escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		{
+			{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "/"},
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "dir/../../escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	}
+
+	for i, layer := range layers {
+		err := Unpack(context.Background(), generateTarFromHeaders(layer), dir, nil)
+		if _, ok := errors.Cause(err).(*TraversalError); !ok {
+			t.Fatalf("layer %d: expected a traversal error, got %v", i, err)
+		}
+
+		if _, err := os.Lstat(filepath.Join(base, "escape")); !os.IsNotExist(err) {
+			t.Fatalf("layer %d: escaped the destination", i)
+		}
+	}
+}
+
+func TestUntarWhiteoutTraversal(t *testing.T) {
+	base, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	dir := filepath.Join(base, "dest")
+	if err := ioutil.WriteFile(filepath.Join(base, "escape"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layers := [][]tar.Header{
+		{
+			{Name: "root", Typeflag: tar.TypeSymlink, Linkname: "/"},
+			{Name: "root/" + whiteoutPrefix + "escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		{
+			{Name: "../" + whiteoutPrefix + "escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	}
+
+	for i, layer := range layers {
+		err := Unpack(context.Background(), generateTarFromHeaders(layer), dir, nil)
+		if _, ok := errors.Cause(err).(*TraversalError); !ok {
+			t.Fatalf("layer %d: expected a traversal error, got %v", i, err)
+		}
+
+		if _, err := os.Lstat(filepath.Join(base, "escape")); err != nil {
+			t.Fatalf("layer %d: a whiteout removed a file outside of the destination", i)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package tarutil
+
+// Rootless ownership is recorded in the same xattr as umoci uses, holding the
+// protobuf encoding of rootlesscontainers.Resource:
+//
+//	message Resource {
+//	  uint32 uid = 1;
+//	  uint32 gid = 2;
+//	}
+//
+// See https://rootlesscontaine.rs/proposals/user.rootlesscontainers/.
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	rootlessXattr = "user.rootlesscontainers"
+	// rootlessNoopID leaves the ID of a resource unchanged.
+	rootlessNoopID = 0xffffffff
+
+	protoVarint  = 0
+	proto64Bit   = 1
+	protoBytes   = 2
+	proto32Bit   = 5
+	protoUIDTag  = 1<<3 | protoVarint
+	protoGIDTag  = 2<<3 | protoVarint
+	protoMaxSize = 2 * (1 + binary.MaxVarintLen32)
+)
+
+// encodeRootless encodes the ownership of a resource. Zero IDs are omitted, as
+// protobuf does for default values.
+func encodeRootless(uid, gid uint32) []byte {
+	buf := make([]byte, 0, protoMaxSize)
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	if uid != 0 {
+		buf = append(buf, protoUIDTag)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(uid))]...)
+	}
+
+	if gid != 0 {
+		buf = append(buf, protoGIDTag)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(gid))]...)
+	}
+
+	return buf
+}
+
+func skipProtoField(wireType uint64, b []byte) (int, bool) {
+	switch wireType {
+	case protoVarint:
+		_, n := binary.Uvarint(b)
+		return n, n > 0
+	case proto64Bit:
+		return 8, len(b) >= 8
+	case proto32Bit:
+		return 4, len(b) >= 4
+	case protoBytes:
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size {
+			return 0, false
+		}
+		return n + int(size), true
+	}
+
+	return 0, false
+}
+
+// decodeRootless decodes the ownership of a resource, skipping unknown fields.
+func decodeRootless(b []byte) (uint32, uint32, error) {
+	var uid, gid uint32
+
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, 0, errors.New("malformed rootlesscontainers xattr")
+		}
+		b = b[n:]
+
+		if tag == protoUIDTag || tag == protoGIDTag {
+			value, n := binary.Uvarint(b)
+			if n <= 0 || value > rootlessNoopID {
+				return 0, 0, errors.New("malformed rootlesscontainers xattr")
+			}
+			b = b[n:]
+
+			if tag == protoUIDTag {
+				uid = uint32(value)
+			} else {
+				gid = uint32(value)
+			}
+			continue
+		}
+
+		n, ok := skipProtoField(tag&7, b)
+		if !ok {
+			return 0, 0, errors.New("malformed rootlesscontainers xattr")
+		}
+		b = b[n:]
+	}
+
+	return uid, gid, nil
+}
+
+// setRootlessOwner records the ownership of an unpacked entry in the
+// rootlesscontainers xattr. Entries owned by root have no xattr, so it is
+// removed from directories which existed before. User xattrs cannot be set on
+// symlinks, so their ownership is not recorded. The owner must be able to
+// write the entry.
+func setRootlessOwner(destPath string, header *tar.Header, existed bool) error {
+	fi, err := os.Lstat(destPath)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if header.Uid == 0 && header.Gid == 0 {
+		// a directory from a previous layer may have been owned by someone
+		// else; entries created by this unpack have no xattr yet.
+		if !existed {
+			return nil
+		}
+		if err := syscall.Removexattr(destPath, rootlessXattr); err != nil && err != syscall.ENODATA {
+			return err
+		}
+		return nil
+	}
+
+	return Lsetxattr(destPath, rootlessXattr, encodeRootless(uint32(header.Uid), uint32(header.Gid)), 0)
+}
+
+// rootlessOwner sets the ownership of a packed header from the
+// rootlesscontainers xattr. Entries without the xattr are owned by root.
+func rootlessOwner(p string, header *tar.Header) error {
+	value, err := Lgetxattr(p, rootlessXattr)
+	if err != nil && err != syscall.ENOTSUP {
+		return err
+	}
+
+	uid, gid, err := decodeRootless(value)
+	if err != nil {
+		return err
+	}
+
+	if uid == rootlessNoopID {
+		uid = 0
+	}
+	if gid == rootlessNoopID {
+		gid = 0
+	}
+
+	header.Uid, header.Gid = int(uid), int(gid)
+	header.Uname, header.Gname = "", ""
+	return nil
+}
@@ -0,0 +1,178 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRootlessEncoding(t *testing.T) {
+	encoded := encodeRootless(1000, 100)
+	if !bytes.Equal(encoded, []byte{0x08, 0xe8, 0x07, 0x10, 0x64}) {
+		t.Fatalf("unexpected encoding %x", encoded)
+	}
+
+	if len(encodeRootless(0, 0)) != 0 {
+		t.Fatal("root ownership was not encoded as the empty message")
+	}
+
+	// an unknown length delimited field 3 must be skipped.
+	uid, gid, err := decodeRootless(append([]byte{0x1a, 0x02, 0xff, 0xff}, encoded...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uid != 1000 || gid != 100 {
+		t.Fatalf("expected 1000:100, got %d:%d", uid, gid)
+	}
+
+	if _, _, err := decodeRootless([]byte{0x08}); err == nil {
+		t.Fatal("truncated message was accepted")
+	}
+}
+
+func TestUntarRootless(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	headers := []tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 100},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file", Uid: 1000},
+		{Name: "rootfile", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+
+	if err := Lsetxattr(dir, "user.test", []byte("test"), 0); err != nil {
+		t.Skipf("cannot set user xattrs here: %v", err)
+	}
+
+	options := &Options{Rootless: true}
+	if err := Unpack(context.Background(), generateTarFromHeaders(headers), dir, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := Lgetxattr(filepath.Join(dir, "rootfile"), rootlessXattr); err != nil || value != nil {
+		t.Fatalf("root owned file had ownership recorded: %x, %v", value, err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := PackWithOptions(context.Background(), dir, buf, options); err != nil {
+		t.Fatal(err)
+	}
+
+	packed, err := loopTarAndReturnHeaders(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][2]int{
+		"dir/":     {1000, 100},
+		"dir/file": {1000, 0},
+		"dir/link": {0, 0},
+		"rootfile": {0, 0},
+	}
+
+	if len(packed) != len(expected) {
+		t.Fatalf("expected %d headers, got %d", len(expected), len(packed))
+	}
+
+	for _, header := range packed {
+		if owner := expected[header.Name]; header.Uid != owner[0] || header.Gid != owner[1] {
+			t.Fatalf("%q: expected ownership %v, got %d:%d", header.Name, owner, header.Uid, header.Gid)
+		}
+
+		if _, ok := header.Xattrs[rootlessXattr]; ok {
+			t.Fatalf("%q: rootless xattr was packed", header.Name)
+		}
+	}
+}
+
+// makeWritable gives the owner write access to everything beneath dir, so
+// that an unprivileged user can remove it.
+func makeWritable(dir string) {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode()&os.ModeSymlink == 0 {
+			os.Chmod(p, fi.Mode().Perm()|0700)
+		}
+		return nil
+	})
+}
+
+func TestUntarRootlessUnprivileged(t *testing.T) {
+	if os.Geteuid() == 0 {
+		runUnprivileged(t, "TestUntarRootlessUnprivileged")
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer makeWritable(dir)
+
+	if err := Lsetxattr(dir, "user.test", []byte("test"), 0); err != nil {
+		t.Skipf("cannot set user xattrs here: %v", err)
+	}
+
+	headers := []tar.Header{
+		{Name: "proc/", Typeflag: tar.TypeDir, Mode: 0555},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0444},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0444, Uid: 1000, Gid: 100},
+		{Name: "ro/", Typeflag: tar.TypeDir, Mode: 0555, Uid: 1000},
+		{Name: "ro/file", Typeflag: tar.TypeReg, Mode: 0444, Uid: 1000},
+		{Name: "ro/xattr", Typeflag: tar.TypeReg, Mode: 0444, Uid: 1000, Xattrs: map[string]string{"user.foo": "bar"}},
+	}
+
+	options := &Options{Rootless: true}
+	if err := Unpack(context.Background(), generateTarFromHeaders(headers), dir, options); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range headers {
+		fi, err := os.Lstat(filepath.Join(dir, h.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != os.FileMode(h.Mode) {
+			t.Fatalf("%q: expected mode %o, got %o", h.Name, h.Mode, fi.Mode().Perm())
+		}
+	}
+
+	if value, err := Lgetxattr(filepath.Join(dir, "ro/xattr"), "user.foo"); err != nil || string(value) != "bar" {
+		t.Fatalf("the xattr of a read-only file was not restored: %q, %v", value, err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := PackWithOptions(context.Background(), dir, buf, options); err != nil {
+		t.Fatal(err)
+	}
+
+	packed, err := loopTarAndReturnHeaders(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packed) != len(headers) {
+		t.Fatalf("expected %d headers, got %d", len(headers), len(packed))
+	}
+
+	owners := map[string][2]int{}
+	for _, h := range headers {
+		owners[h.Name] = [2]int{h.Uid, h.Gid}
+	}
+
+	for _, header := range packed {
+		if owner := owners[header.Name]; header.Uid != owner[0] || header.Gid != owner[1] {
+			t.Fatalf("%q: expected ownership %v, got %d:%d", header.Name, owner, header.Uid, header.Gid)
+		}
+	}
+}
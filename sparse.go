@@ -0,0 +1,323 @@
+package tarutil
+
+// Sparse files are packed in the PAX format 1.0 defined by GNU tar: a PAX
+// header carries the GNU.sparse records, and the data of the entry starts
+// with a map of the data regions, followed by the data itself. archive/tar
+// can read these entries, but refuses to write the GNU.sparse records, so the
+// PAX header is written by hand.
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+
+	tarBlockSize    = 512
+	sparseBlockSize = 4096
+	ustarNameSize   = 100
+	ustarOwnerSize  = 32
+	ustarMaxID      = 1<<21 - 1
+	ustarMaxSize    = 1<<33 - 1
+)
+
+type sparseEntry struct {
+	offset int64
+	length int64
+}
+
+// sparseMap returns the data regions of f, or nil if it has no holes or the
+// file system cannot report them.
+func sparseMap(f *os.File, fi os.FileInfo) ([]sparseEntry, error) {
+	size := fi.Size()
+	if fi.Sys().(*syscall.Stat_t).Blocks*512 >= size {
+		return nil, nil
+	}
+
+	entries := []sparseEntry{}
+	for offset := int64(0); offset < size; {
+		data, err := f.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		} else if errors.Is(err, syscall.EINVAL) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, sparseEntry{offset: data, length: hole - data})
+		offset = hole
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 1 && entries[0].offset == 0 && entries[0].length == size {
+		return nil, nil
+	}
+
+	// GNU tar marks a trailing hole with an empty region at the end.
+	if len(entries) == 0 || entries[len(entries)-1].offset+entries[len(entries)-1].length < size {
+		entries = append(entries, sparseEntry{offset: size})
+	}
+
+	return entries, nil
+}
+
+func padToBlock(b []byte) []byte {
+	if rem := len(b) % tarBlockSize; rem != 0 {
+		b = append(b, make([]byte, tarBlockSize-rem)...)
+	}
+	return b
+}
+
+func sparseMapBlock(entries []sparseEntry) []byte {
+	b := []byte(strconv.Itoa(len(entries)) + "\n")
+	for _, e := range entries {
+		b = append(b, strconv.FormatInt(e.offset, 10)+"\n"+strconv.FormatInt(e.length, 10)+"\n"...)
+	}
+	return padToBlock(b)
+}
+
+func paxRecord(k, v string) string {
+	const padding = 3 // ' ', '=' and '\n'
+	size := len(k) + len(v) + padding
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+
+	// the length of the size may have grown the record.
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+
+	return record
+}
+
+// sparseRecords returns the PAX records of a sparse entry, including those
+// the header itself would have needed.
+func sparseRecords(header *tar.Header) map[string]string {
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     header.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(header.Size, 10),
+	}
+
+	for k, v := range header.PAXRecords {
+		records[k] = v
+	}
+	for k, v := range header.Xattrs {
+		records[paxSchilyXattr+k] = v
+	}
+
+	if !header.AccessTime.IsZero() {
+		records["atime"] = strconv.FormatInt(header.AccessTime.Unix(), 10)
+	}
+	if !header.ChangeTime.IsZero() {
+		records["ctime"] = strconv.FormatInt(header.ChangeTime.Unix(), 10)
+	}
+	if header.Uid > ustarMaxID {
+		records["uid"] = strconv.Itoa(header.Uid)
+	}
+	if header.Gid > ustarMaxID {
+		records["gid"] = strconv.Itoa(header.Gid)
+	}
+	if len(header.Uname) > ustarOwnerSize {
+		records["uname"] = header.Uname
+	}
+	if len(header.Gname) > ustarOwnerSize {
+		records["gname"] = header.Gname
+	}
+
+	return records
+}
+
+func truncateName(name string, size int) string {
+	if len(name) > size {
+		return name[len(name)-size:]
+	}
+	return name
+}
+
+// paxHeader encodes records as a PAX extended header, with its data.
+func paxHeader(header *tar.Header, records map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	data := ""
+	for _, k := range keys {
+		data += paxRecord(k, records[k])
+	}
+
+	// archive/tar refuses to write extended headers, so write a regular
+	// header and change its type.
+	buf := new(bytes.Buffer)
+	err := tar.NewWriter(buf).WriteHeader(&tar.Header{
+		Name:     truncateName(path.Join(path.Dir(header.Name), "PaxHeaders.0", path.Base(header.Name)), ustarNameSize),
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  header.ModTime,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatUSTAR,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	block := buf.Bytes()[:tarBlockSize]
+	block[156] = tar.TypeXHeader
+
+	var sum int64
+	copy(block[148:156], "        ")
+	for _, b := range block {
+		sum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	return padToBlock(append(block, data...)), nil
+}
+
+func ustarID(id int) int {
+	if id > ustarMaxID {
+		return 0
+	}
+	return id
+}
+
+// writeSparseFile writes the data regions of f as a sparse entry. GNU tar
+// only reads the entry if its header is in the USTAR format, so anything
+// USTAR cannot encode is left to the PAX header.
+func writeSparseFile(ctx context.Context, tw *tarWriter, f *os.File, header *tar.Header, entries []sparseEntry, size int64) error {
+	pax, err := paxHeader(header, sparseRecords(header))
+	if err != nil {
+		return err
+	}
+
+	// the extended header must come right before the header it describes.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if _, err := tw.w.Write(pax); err != nil {
+		return err
+	}
+
+	sparseHeader := &tar.Header{
+		Name:     truncateName(path.Join(path.Dir(header.Name), "GNUSparseFile.0", path.Base(header.Name)), ustarNameSize),
+		Mode:     header.Mode,
+		Uid:      ustarID(header.Uid),
+		Gid:      ustarID(header.Gid),
+		Uname:    truncateName(header.Uname, ustarOwnerSize),
+		Gname:    truncateName(header.Gname, ustarOwnerSize),
+		Size:     size,
+		ModTime:  header.ModTime,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatUSTAR,
+	}
+	if err := tw.WriteHeader(sparseHeader); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(sparseMapBlock(entries)); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if _, err := f.Seek(e.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, &ctxReader{ctx: ctx, r: f}, e.length); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeSparse writes the regular file p as a sparse entry if it has holes.
+// It returns false if the file was not written.
+func writeSparse(ctx context.Context, tw *tarWriter, p string, header *tar.Header, fi os.FileInfo) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	entries, err := sparseMap(f, fi)
+	if err != nil || entries == nil {
+		return false, err
+	}
+
+	size := int64(len(sparseMapBlock(entries)))
+	for _, e := range entries {
+		size += e.length
+	}
+
+	// USTAR cannot encode the size, so the holes are packed too.
+	if size > ustarMaxSize {
+		return false, nil
+	}
+
+	return true, writeSparseFile(ctx, tw, f, header, entries, size)
+}
+
+// sparseWriter writes to a file, leaving holes instead of blocks of zeros.
+type sparseWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if len(chunk) > sparseBlockSize {
+			chunk = chunk[:sparseBlockSize]
+		}
+
+		if !isZero(chunk) {
+			if n, err := s.f.WriteAt(chunk, s.offset); err != nil {
+				return written + n, err
+			}
+		}
+
+		s.offset += int64(len(chunk))
+		written += len(chunk)
+	}
+
+	return len(p), nil
+}
+
+// Close sets the size of the file, which may end in a hole.
+func (s *sparseWriter) Close() error {
+	return s.f.Truncate(s.offset)
+}
@@ -0,0 +1,153 @@
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func allocated(t *testing.T, p string) int64 {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestPackSparse(t *testing.T) {
+	const size = 64 << 20
+
+	packDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	if err := os.Mkdir(filepath.Join(packDir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sparse := filepath.Join(packDir, "dir", "sparse")
+	f, err := os.Create(sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("middle"), size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if allocated(t, sparse) >= size {
+		t.Skip("file system does not support holes")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(packDir, "dir", "z"), []byte("after"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := PackWithOptions(context.Background(), packDir, buf, &Options{Sparse: true}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if len(data) > 1<<20 {
+		t.Fatalf("holes were packed: %d bytes", len(data))
+	}
+
+	headers, err := loopTarAndReturnHeaders(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"dir/", "dir/sparse", "dir/z"}
+	if len(headers) != len(expected) {
+		t.Fatalf("expected %d headers, got %d", len(expected), len(headers))
+	}
+
+	for i, name := range expected {
+		if headers[i].Name != name {
+			t.Fatalf("expected %q, got %q", name, headers[i].Name)
+		}
+	}
+
+	if headers[1].Size != size {
+		t.Fatalf("expected the real size %d, got %d", size, headers[1].Size)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := Unpack(context.Background(), bytes.NewReader(data), dir, &Options{Sparse: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	unpacked := filepath.Join(dir, "dir", "sparse")
+	if n := allocated(t, unpacked); n >= 1<<20 {
+		t.Fatalf("holes were written: %d bytes allocated", n)
+	}
+
+	content, err := ioutil.ReadFile(unpacked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(content) != size || string(content[size/2:size/2+6]) != "middle" {
+		t.Fatal("sparse file content was not restored")
+	}
+}
+
+func TestUntarSparseZeros(t *testing.T) {
+	const size = 16 << 20
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "zeros", Typeflag: tar.TypeReg, Mode: 0644, Size: size + 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(tw, io.LimitReader(zeroReader{}, size)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := Unpack(context.Background(), buf, dir, &Options{Sparse: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(dir, "zeros")
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != size+4 {
+		t.Fatalf("expected size %d, got %d", size+4, fi.Size())
+	}
+
+	if n := allocated(t, p); n >= size {
+		t.Fatalf("holes were written: %d bytes allocated", n)
+	}
+}
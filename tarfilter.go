@@ -15,62 +15,122 @@ type TarFilter interface {
 	Close() error
 }
 
+// FilterReader is the filtered tar stream returned by FilterTarUsingFilter
+// and FilterTarUsingEntryFilter.
+type FilterReader struct {
+	pr   *io.PipeReader
+	done chan struct{}
+	err  error
+}
+
+// Read reads the filtered tar stream. Errors reading or filtering the input
+// are returned once the output written before them has been read.
+func (fr *FilterReader) Read(p []byte) (int, error) {
+	return fr.pr.Read(p)
+}
+
+// Wait waits for filtering to finish, and returns the error it failed with,
+// if any. The output must be read to the end or closed first, or Wait blocks
+// forever.
+func (fr *FilterReader) Wait() error {
+	<-fr.done
+	return fr.err
+}
+
+// Close stops filtering; the input is not read any further.
+func (fr *FilterReader) Close() error {
+	return fr.pr.Close()
+}
+
 // FilterTarUsingFilter accepts a tar file in the io.Reader and a Tarfilter,
-// and then runs the filter repeatedly on the reader.
-func FilterTarUsingFilter(r io.Reader, f TarFilter) (io.Reader, error) {
+// and then runs the filter repeatedly on the reader. Compressed input is
+// detected and decompressed; the output is always a plain tar stream. Once
+// the input is exhausted the filter is closed, followed by the tar writer.
+// The input is only read in a goroutine, so it may be written after
+// FilterTarUsingFilter returns; errors decompressing it are returned by Read
+// and Wait.
+func FilterTarUsingFilter(r io.Reader, f TarFilter) (*FilterReader, error) {
+	return FilterTarUsingFilterWithOptions(r, f, nil)
+}
+
+// FilterTarUsingFilterWithOptions filters a tar stream like
+// FilterTarUsingFilter, decompressing the input according to the options.
+func FilterTarUsingFilterWithOptions(r io.Reader, f TarFilter, options *Options) (*FilterReader, error) {
+	return startFilter(r, options, f.SetTarWriter, func(tr *tar.Reader, tw *tar.Writer) error {
+		return filterTar(tr, tw, f)
+	})
+}
+
+// startFilter runs filter over the input, decompressed according to the
+// options, in a goroutine, with a tar writer feeding the returned reader.
+// setup, if given, is called with the tar writer first. The input is only
+// read from the goroutine, so it may be written after startFilter returns.
+func startFilter(r io.Reader, options *Options, setup func(*tar.Writer) error, filter func(*tar.Reader, *tar.Writer) error) (*FilterReader, error) {
 	var (
-		pr, pw      = io.Pipe()
-		tr          = tar.NewReader(r)
-		tw          = tar.NewWriter(pw)
-		writeData   bool
-		writeHeader bool
+		pr, pw = io.Pipe()
+		tw     = tar.NewWriter(pw)
+		fr     = &FilterReader{pr: pr, done: make(chan struct{})}
 	)
 
-	if err := f.SetTarWriter(tw); err != nil {
-		pw.CloseWithError(err)
-		return nil, err
+	if setup != nil {
+		if err := setup(tw); err != nil {
+			pw.CloseWithError(err)
+			return nil, err
+		}
 	}
 	go func() {
-		for {
-			hdr, err := tr.Next()
-			if err == io.EOF {
-				f.Close()
-				pw.CloseWithError(err)
-				break
-			}
+		defer close(fr.done)
 
-			if err != nil {
-				pw.Close()
-				break
-			}
+		fr.err = decompressAndFilter(r, options, tw, filter)
+		pw.CloseWithError(fr.err)
+	}()
+	return fr, nil
+}
 
-			writeData, writeHeader, err = f.HandleEntry(hdr)
-			if err != nil {
-				pw.CloseWithError(err)
-				break
-			}
+func decompressAndFilter(r io.Reader, options *Options, tw *tar.Writer, filter func(*tar.Reader, *tar.Writer) error) error {
+	dr, err := Decompress(r, options)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
 
-			if !writeHeader {
-				continue
-			}
-			err = tw.WriteHeader(hdr)
-			if err != nil {
-				pw.CloseWithError(err)
-				break
-			}
+	return filter(tar.NewReader(dr), tw)
+}
 
-			if !writeData || hdr.Size == 0 {
-				continue
-			}
+func filterTar(tr *tar.Reader, tw *tar.Writer, f TarFilter) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
 
-			_, err = io.Copy(tw, tr)
-			if err != nil {
-				pw.CloseWithError(err)
-				break
-			}
+		writeData, writeHeader, err := f.HandleEntry(hdr)
+		if err != nil {
+			return err
 		}
-	}()
-	return pr, nil
+
+		if !writeHeader {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !writeData || hdr.Size == 0 {
+			continue
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return tw.Close()
 }
 
 // OverlayWhiteouts is a TarFilter to handle overlay whiteout files.
@@ -130,7 +190,8 @@ func (o *OverlayWhiteouts) HandleEntry(h *tar.Header) (bool, bool, error) {
 			if o.previousEntry.Xattrs == nil {
 				o.previousEntry.Xattrs = make(map[string]string)
 			}
-			o.previousEntry.Xattrs["trusted.overlay.opaque"] = "y"
+			o.previousEntry.Xattrs[overlayOpaqueXattr] = overlayOpaqueXattrValue
+			o.previousEntry.Format = tar.FormatPAX
 			err := o.tw.WriteHeader(o.previousEntry)
 			o.previousEntry = nil
 			return false, false, err
@@ -153,4 +214,7 @@ func convertWhiteoutToOverlay(h *tar.Header, dir, base string) {
 	originalPath := filepath.Join(dir, originalBase)
 	h.Typeflag = tar.TypeChar
 	h.Name = originalPath
+	h.Devmajor = 0
+	h.Devminor = 0
+	h.Size = 0
 }
@@ -2,9 +2,13 @@ package tarutil
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 type NullFilter struct {
@@ -159,3 +163,111 @@ func TestOverlayWhiteouts(t *testing.T) {
 		}
 	}
 }
+
+type closeErrorFilter struct {
+	NullFilter
+}
+
+var errCloseFilter = errors.New("close failed")
+
+func (c *closeErrorFilter) Close() error {
+	return errCloseFilter
+}
+
+func TestTarFilterTruncatedInput(t *testing.T) {
+	content, err := ioutil.ReadAll(generateTar(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := FilterTarUsingFilter(bytes.NewReader(content[:3*512+100]), &NullFilter{})
+	if err != nil {
+		t.Fatalf("failed to instantiate filter")
+	}
+
+	if _, err := loopTar(fr, false); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v reading the output, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	if err := fr.Wait(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v from Wait, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestTarFilterCloseError(t *testing.T) {
+	fr, err := FilterTarUsingFilter(generateTar(5), &closeErrorFilter{})
+	if err != nil {
+		t.Fatalf("failed to instantiate filter")
+	}
+
+	if _, err := ioutil.ReadAll(fr); err != errCloseFilter {
+		t.Fatalf("expected %v reading the output, got %v", errCloseFilter, err)
+	}
+
+	if err := fr.Wait(); err != errCloseFilter {
+		t.Fatalf("expected %v from Wait, got %v", errCloseFilter, err)
+	}
+}
+
+func TestTarFilterWait(t *testing.T) {
+	fr, err := FilterTarUsingFilter(generateTar(5), &NullFilter{})
+	if err != nil {
+		t.Fatalf("failed to instantiate filter")
+	}
+
+	items, err := loopTar(fr, false)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	if items != 10 {
+		t.Fatalf("processed only %v items, not 10", items)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, fr); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.Wait(); err != nil {
+		t.Fatalf("filtering failed: %v", err)
+	}
+}
+
+func TestTarFilterPipeWrittenLater(t *testing.T) {
+	content, err := ioutil.ReadAll(generateTar(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := new(bytes.Buffer)
+	w, err := Compress(compressed, &Options{Compression: Gzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	w.Close()
+
+	pr, pw := io.Pipe()
+	fr, err := FilterTarUsingFilter(pr, &NullFilter{})
+	if err != nil {
+		t.Fatalf("failed to instantiate filter")
+	}
+
+	go func() {
+		pw.CloseWithError(func() error {
+			_, err := io.Copy(pw, compressed)
+			return err
+		}())
+	}()
+
+	items, err := loopTar(fr, false)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	if items != 10 {
+		t.Fatalf("processed only %v items, not 10", items)
+	}
+
+	io.Copy(ioutil.Discard, fr)
+	if err := fr.Wait(); err != nil {
+		t.Fatalf("filtering failed: %v", err)
+	}
+}
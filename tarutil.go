@@ -1,32 +1,311 @@
 package tarutil
 
 import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
 
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
+var maxTime time.Time
+
+// Errors describing invalid tar entries. They are usually wrapped in an
+// *EntryError, and can be tested for with errors.Is.
 var (
-	maxTime                  time.Time
-	errSyscallNotImplemented = errors.New("syscall not implemented")
-	errFailedOpen            = errors.New("failed to open file")
-	errFailedWrite           = errors.New("failed to write file")
-	errPathIsNonDirectory    = errors.New("path exists, but it's not a directory")
-	errDirectoryExists       = errors.New("expected directory to not exist")
-	errDirectoryCreateFailed = errors.New("failed to create directory")
-	errInvalidSymlink        = errors.New("invalid symlink")
-	errInvalidLink           = errors.New("invalid hard link")
-	errRead                  = errors.New("encountered error while reading")
-	errUnknownHeader         = errors.New("encountered unknown header")
+	ErrPathIsNonDirectory = errors.New("path exists, but it's not a directory")
+	ErrInvalidSymlink     = errors.New("invalid symlink")
+	ErrInvalidLink        = errors.New("invalid hard link")
+	ErrUnknownHeader      = errors.New("encountered unknown header")
+	ErrInvalidWhiteout    = errors.New("invalid whiteout")
+	ErrInvalidACL         = errors.New("invalid ACL")
+	ErrIDNotMapped        = errors.New("id is not mapped")
+	ErrMountPoint         = errors.New("path is on a different file system")
 )
 
+// Errors returned when compressing or decompressing a tar stream.
+var (
+	ErrForbiddenCompression   = errors.New("compression is forbidden")
+	ErrUnknownCompression     = errors.New("unknown compression")
+	ErrUnsupportedCompression = errors.New("compression is not supported for writing")
+)
+
+// ErrDigestMismatch is returned when an unpacked stream does not match the
+// digests expected by the options.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// EntryError records a failure to pack or unpack a single tar entry.
+type EntryError struct {
+	// Op is the operation which failed, such as "create" or "chown".
+	Op string
+	// Name is the name of the tar entry.
+	Name string
+	// Path is the path of the entry on disk.
+	Path string
+	// Typeflag is the type of the tar entry.
+	Typeflag byte
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s %q (type %q) at %q: %v", e.Op, e.Name, e.Typeflag, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the underlying error, for use with errors.Cause from
+// github.com/pkg/errors.
+func (e *EntryError) Cause() error {
+	return e.Err
+}
+
+// newEntryError wraps err in an *EntryError for the entry described by
+// header. It returns nil if err is nil, and err itself if it already is an
+// *EntryError.
+func newEntryError(op string, header *tar.Header, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*EntryError); ok {
+		return err
+	}
+
+	return &EntryError{Op: op, Name: header.Name, Path: path, Typeflag: header.Typeflag, Err: err}
+}
+
 type stringMap map[string]struct{}
 
+// ctxReader fails reads once its context is done, so that long copies can be
+// interrupted.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
+
+// WhiteoutMode describes how whiteout entries are handled on disk.
+type WhiteoutMode int
+
+const (
+	// WhiteoutsApply removes the paths shadowed by AUFS whiteout entries
+	// instead of writing the whiteouts themselves. This is the default.
+	WhiteoutsApply WhiteoutMode = iota
+	// WhiteoutsKeep writes AUFS whiteout entries to disk as regular files.
+	WhiteoutsKeep
+	// WhiteoutsOverlay writes whiteouts the way overlayfs expects to find
+	// them in an upper directory: a 0/0 character device for each removed
+	// path, and the trusted.overlay.opaque xattr on opaque directories.
+	// Pack converts whiteouts in this form back to AUFS whiteouts.
+	WhiteoutsOverlay
+)
+
+// MountMode describes how Pack treats file systems mounted beneath the
+// directory it packs.
+type MountMode int
+
+const (
+	// MountsCross packs the contents of mounted file systems like any other
+	// directory. This is the default.
+	MountsCross MountMode = iota
+	// MountsSkip leaves out mount points and everything beneath them, like
+	// tar --one-file-system.
+	MountsSkip
+	// MountsFail fails the pack with ErrMountPoint when it finds a mount
+	// point.
+	MountsFail
+)
+
+// SymlinkMode describes how Pack stores the targets of symlinks.
+type SymlinkMode int
+
+const (
+	// SymlinksRelative rewrites every target relative to the symlink,
+	// resolving absolute targets on the host. This is the default.
+	SymlinksRelative SymlinkMode = iota
+	// SymlinksVerbatim stores targets as they are.
+	SymlinksVerbatim
+	// SymlinksRootRelative rewrites absolute targets relative to the
+	// symlink, resolving them inside the packed directory as if it were the
+	// root. Relative targets are stored as they are.
+	SymlinksRootRelative
+)
+
+// XattrPolicy describes what Unpack does with the extended attributes of a
+// namespace.
+type XattrPolicy int
+
+const (
+	// XattrsBestEffort restores xattrs, ignoring failures caused by the file
+	// system not supporting them or by a lack of privileges. This is the
+	// default.
+	XattrsBestEffort XattrPolicy = iota
+	// XattrsRequire restores xattrs, and fails the unpack if any cannot be.
+	XattrsRequire
+	// XattrsSkip never restores xattrs.
+	XattrsSkip
+)
+
 // Options controls the behavior of some tarball related operations.
 type Options struct {
-	NoLchown bool
+	NoLchown  bool
+	Whiteouts WhiteoutMode
+
+	// Compression forces the codec of the stream being unpacked or filtered,
+	// which is detected from the stream by default. When packing it selects the codec
+	// to write with; only gzip and zstd are supported, and the default is to
+	// write a plain tar stream.
+	Compression Compression
+	// ForbidCompression lists codecs which are refused when unpacking or
+	// filtering.
+	ForbidCompression []Compression
+	// CompressionLevel is the codec specific level to compress with. Zero
+	// selects the codec's default.
+	CompressionLevel int
+	// ParallelCompression compresses on multiple goroutines.
+	ParallelCompression bool
+
+	// ExpectedDigest and ExpectedDiffID are verified against the stream
+	// once it is unpacked; see Result for what they cover. Unpack fails
+	// with ErrDigestMismatch if they differ, after extracting the contents.
+	ExpectedDigest digest.Digest
+	ExpectedDiffID digest.Digest
+
+	// Reproducible drops access and change times from packed headers, and
+	// always writes the PAX format, so that identical trees pack to
+	// identical streams.
+	Reproducible bool
+	// SourceDateEpoch clamps packed modification times which are later than
+	// it, if set.
+	SourceDateEpoch time.Time
+	// NormalizeOwnership packs every entry as owned by uid and gid 0, without
+	// user or group names.
+	NormalizeOwnership bool
+
+	// Excludes lists patterns, with .dockerignore semantics, of paths which
+	// Pack leaves out. Patterns are relative to the source, may use "**" to
+	// match any number of directories, and re-include paths if they start
+	// with "!". The last matching pattern wins.
+	Excludes []string
+	// ExcludesFile names a file in the source, such as ".dockerignore", to
+	// read more patterns from. They are applied after Excludes.
+	ExcludesFile string
+
+	// XattrNamespaces lists the xattr namespaces, such as "user" or
+	// "security", which Pack stores and Unpack restores. All namespaces are
+	// included by default. The trusted.overlay xattrs used by overlayfs are
+	// never packed.
+	XattrNamespaces []string
+	// XattrPolicies sets the policy for restoring the xattrs of a namespace.
+	// Namespaces without a policy use XattrsBestEffort.
+	XattrPolicies map[string]XattrPolicy
+
+	// UIDMaps and GIDMaps map the IDs in tarballs to IDs on the host, for
+	// unpacking into and packing from user namespaces. Unpack translates the
+	// ownership and the ACL qualifiers of each entry to the host, and Pack
+	// translates them back. IDs outside of the mappings fail with
+	// ErrIDNotMapped, before the entry is written. No mappings means IDs are
+	// used as they are.
+	UIDMaps []IDMap
+	GIDMaps []IDMap
+
+	// Rootless records ownership in the user.rootlesscontainers xattr used
+	// by umoci instead of changing it, for unprivileged users. Unpack stores
+	// the ownership of each entry which is not owned by root, and Pack reads
+	// it back; entries without the xattr are packed as owned by root.
+	// Directories stay writable by their owner until the whole layer has
+	// been unpacked, so that read-only directories can be populated.
+	Rootless bool
+
+	// Sparse makes Pack find the holes in regular files, and write files
+	// which have any as PAX sparse entries in the GNU 1.0 format. Unpack
+	// leaves holes in place of blocks of zeros instead of writing them.
+	Sparse bool
+
+	// Mounts controls whether Pack crosses into other file systems.
+	Mounts MountMode
+
+	// Symlinks controls how Pack stores symlink targets.
+	Symlinks SymlinkMode
+}
+
+// Result describes a tar stream written by Pack or Diff, or read by Unpack.
+type Result struct {
+	// DiffID is the digest of the uncompressed tar stream.
+	DiffID digest.Digest
+	// Digest is the digest of the stream as written or read, after
+	// compression.
+	Digest digest.Digest
+	// Size is the number of bytes written or read, after compression.
+	Size int64
+	// UncompressedSize is the size of the uncompressed tar stream.
+	UncompressedSize int64
+	// Entries is the number of entries in the tar stream.
+	Entries int
+}
+
+func whiteoutMode(options *Options) WhiteoutMode {
+	if options == nil {
+		return WhiteoutsApply
+	}
+	return options.Whiteouts
+}
+
+func mountMode(options *Options) MountMode {
+	if options == nil {
+		return MountsCross
+	}
+	return options.Mounts
+}
+
+func symlinkMode(options *Options) SymlinkMode {
+	if options == nil {
+		return SymlinksRelative
+	}
+	return options.Symlinks
+}
+
+func xattrNamespace(name string) string {
+	return strings.SplitN(name, ".", 2)[0]
+}
+
+func xattrAllowed(name string, options *Options) bool {
+	if options == nil || options.XattrNamespaces == nil {
+		return true
+	}
+
+	namespace := xattrNamespace(name)
+	for _, allowed := range options.XattrNamespaces {
+		if namespace == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func xattrPolicy(name string, options *Options) XattrPolicy {
+	if options == nil {
+		return XattrsBestEffort
+	}
+	return options.XattrPolicies[xattrNamespace(name)]
 }
 
 func init() {
@@ -28,7 +28,7 @@ func TestDirectoryExists(t *testing.T) {
 	}
 
 	ok, err = directoryExists("/dev/null")
-	if errors.Cause(err) != errPathIsNonDirectory {
+	if !errors.Is(err, ErrPathIsNonDirectory) {
 		t.Fatalf("expected error: %v", err)
 	}
 
@@ -4,13 +4,16 @@ import (
 	"archive/tar"
 	"context"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
 	"unsafe"
 
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -30,7 +33,7 @@ func luTimesNano(path string, ts []syscall.Timespec) error {
 
 	_, _, res := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atFdCwd), uintptr(unsafe.Pointer(_path)), uintptr(unsafe.Pointer(&ts[0])), uintptr(atSymLinkNoFollow), 0, 0)
 	if res != 0 && res != syscall.ENOSYS {
-		return errSyscallNotImplemented
+		return &os.PathError{Op: "utimensat", Path: path, Err: res}
 	}
 
 	return nil
@@ -70,7 +73,7 @@ func timeToTimespec(time time.Time) syscall.Timespec {
 func directoryExists(dirPath string) (bool, error) {
 	fi, err := os.Lstat(dirPath)
 	if err == nil && !fi.IsDir() {
-		return false, errors.Wrap(errPathIsNonDirectory, dirPath)
+		return false, errors.Wrap(ErrPathIsNonDirectory, dirPath)
 	}
 	if err != nil {
 		return false, nil
@@ -80,34 +83,48 @@ func directoryExists(dirPath string) (bool, error) {
 }
 
 func createDirectory(destPath string, fi os.FileInfo) error {
-	if _, err := directoryExists(destPath); err != nil {
-		return errors.Wrap(errDirectoryExists, destPath)
-	}
-	if err := os.Mkdir(destPath, fi.Mode()); err != nil {
-		return errors.Wrap(errDirectoryCreateFailed, destPath)
+	exists, err := directoryExists(destPath)
+	if err != nil || exists {
+		return err
 	}
 
-	return nil
+	return os.Mkdir(destPath, fi.Mode())
 }
 
-func createFile(destPath string, fi os.FileInfo, r io.Reader) error {
-	file, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY, fi.Mode())
+func createFile(destPath string, fi os.FileInfo, r io.Reader, sparse bool) error {
+	file, err := os.OpenFile(destPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode())
 	if err != nil {
-		return errors.Wrap(errFailedOpen, destPath)
+		return err
 	}
-	defer file.Close()
-	if _, err := io.Copy(file, r); err != nil {
-		return errors.Wrap(errFailedWrite, destPath)
+
+	var w io.Writer = file
+	if sparse {
+		w = &sparseWriter{f: file}
 	}
 
-	return nil
+	_, err = io.Copy(w, r)
+	if sw, ok := w.(*sparseWriter); ok && err == nil {
+		err = sw.Close()
+	}
+
+	if err != nil {
+		// don't leave a truncated file behind, e.g. when canceled.
+		file.Close()
+		os.Remove(destPath)
+		return err
+	}
+
+	return file.Close()
 }
 
 func createSymlink(dest, destPath string, header *tar.Header) error {
-	targetPath := filepath.Join(filepath.Dir(destPath), header.Linkname)
+	targetPath := filepath.Join(dest, header.Linkname)
+	if !filepath.IsAbs(header.Linkname) {
+		targetPath = filepath.Join(filepath.Dir(destPath), header.Linkname)
+	}
 
-	if !strings.HasPrefix(targetPath, dest) {
-		return errors.Wrap(errInvalidSymlink, header.Linkname)
+	if !isBeneath(dest, targetPath) {
+		return errors.Wrapf(ErrInvalidSymlink, "target %q is outside of the destination", header.Linkname)
 	}
 	return os.Symlink(header.Linkname, destPath)
 }
@@ -131,8 +148,9 @@ func createBlockCharFifo(destPath string, header *tar.Header) error {
 	return syscall.Mknod(destPath, mode, dev)
 }
 
+// handleWhiteouts applies the opaque whiteout at destPath, removing everything
+// in its directory which was not unpacked by this layer.
 func handleWhiteouts(destPath string, unpackedPaths stringMap) error {
-	base := filepath.Base(destPath)
 	dir := filepath.Dir(destPath)
 	walkFn := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -150,33 +168,198 @@ func handleWhiteouts(destPath string, unpackedPaths stringMap) error {
 		return nil
 	}
 
+	if _, err := os.Lstat(dir); err != nil {
+		return err
+	}
+	return filepath.Walk(dir, walkFn)
+}
+
+// whiteoutTarget returns the name a whiteout base name removes, or false if
+// it is not a single path component beneath the whiteout's directory.
+func whiteoutTarget(base string) (string, bool) {
+	originalBase := strings.TrimPrefix(base, whiteoutPrefix)
+	switch {
+	case originalBase == "", originalBase == ".", originalBase == "..":
+		return "", false
+	case strings.ContainsRune(originalBase, '/'):
+		return "", false
+	}
+	return originalBase, true
+}
+
+// applyWhiteout handles AUFS whiteout and metadata entries according to the
+// whiteout mode. It returns true if the entry was consumed and must not be
+// written to disk.
+func applyWhiteout(res *resolver, header *tar.Header, unpackedPaths stringMap, options *Options) (bool, error) {
+	mode := whiteoutMode(options)
+	if mode == WhiteoutsKeep {
+		return false, nil
+	}
+
+	name := filepath.Clean(header.Name)
+	if strings.HasPrefix(name, whiteoutMetaPrefix) && name != whiteoutOpaqueDir {
+		// aufs metadata, such as the hard link directory, is never extracted.
+		return true, nil
+	}
+
+	base := filepath.Base(name)
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return false, nil
+	}
+
 	if base == whiteoutOpaqueDir {
-		if _, err := os.Lstat(dir); err != nil {
-			return err
+		destPath, err := res.resolve(header.Name)
+		if err != nil {
+			return false, newEntryError("resolve", header, destPath, err)
 		}
-		return filepath.Walk(dir, walkFn)
+
+		if mode == WhiteoutsOverlay {
+			err = Lsetxattr(filepath.Dir(destPath), overlayOpaqueXattr, []byte(overlayOpaqueXattrValue), 0)
+		} else {
+			err = handleWhiteouts(destPath, unpackedPaths)
+		}
+		return true, newEntryError("whiteout", header, destPath, err)
+	}
+
+	originalBase, ok := whiteoutTarget(base)
+	if !ok {
+		return false, newEntryError("whiteout", header, "", ErrInvalidWhiteout)
+	}
+
+	// the path removed is resolved like any entry, so it stays beneath the
+	// root.
+	destPath, err := res.resolve(filepath.Join(filepath.Dir(name), originalBase))
+	if err != nil {
+		return false, newEntryError("resolve", header, destPath, err)
+	}
+	if filepath.Base(destPath) != originalBase {
+		return false, newEntryError("whiteout", header, destPath, ErrInvalidWhiteout)
+	}
+
+	if mode == WhiteoutsOverlay {
+		convertWhiteoutToOverlay(header, filepath.Dir(name), base)
+		return false, nil
 	}
 
-	originalBase := base[len(whiteoutPrefix):]
-	originalPath := filepath.Join(dir, originalBase)
-	return os.RemoveAll(originalPath)
+	return true, newEntryError("whiteout", header, destPath, os.RemoveAll(destPath))
 }
 
-func setPermissions(destPath string, header *tar.Header, options *Options) error {
-	if options == nil || !options.NoLchown {
-		if err := os.Lchown(destPath, header.Uid, header.Gid); err != nil {
-			return err
-		}
+// removeExisting clears the way for an entry which replaces a path unpacked
+// by a previous layer. Directories are merged instead of replaced; it returns
+// true if an existing directory was kept.
+func removeExisting(destPath string, header *tar.Header) (bool, error) {
+	fi, err := os.Lstat(destPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if fi.IsDir() && header.Typeflag == tar.TypeDir {
+		return true, nil
+	}
+
+	return false, os.RemoveAll(destPath)
+}
+
+// entryOwner returns the host uid and gid an entry is to be chowned to. It is
+// called before anything is written, so that an unmapped ID fails the entry
+// without leaving it behind.
+func entryOwner(header *tar.Header, options *Options) (int, int, error) {
+	if options != nil && (options.Rootless || options.NoLchown) {
+		return header.Uid, header.Gid, nil
+	}
+
+	return hostIDs(header, options)
+}
+
+func setOwner(destPath string, header *tar.Header, uid, gid int, existed bool, options *Options) error {
+	if options != nil && options.Rootless {
+		return newEntryError("setxattr", header, destPath, setRootlessOwner(destPath, header, existed))
+	}
+
+	if options != nil && options.NoLchown {
+		return nil
+	}
+
+	return newEntryError("chown", header, destPath, os.Lchown(destPath, uid, gid))
+}
+
+// unpackMode returns the mode an entry has while the layer is unpacked.
+// Unprivileged users cannot create entries in directories they cannot write,
+// so in rootless mode directories are accessible to their owner until all
+// entries have been unpacked, when changeDirTimes sets their final mode.
+func unpackMode(header *tar.Header, options *Options) os.FileMode {
+	mode := header.FileInfo().Mode()
+	if options != nil && options.Rootless && header.Typeflag == tar.TypeDir {
+		mode |= 0700
 	}
+	return mode
+}
 
-	headerFi := header.FileInfo()
+// setPermissions sets the owner, the xattrs and ACLs passed to
+// restoreXattrs, and then the mode of an entry.
+func setPermissions(destPath string, header *tar.Header, uid, gid int, existed bool, xattrs map[string]string, options *Options) error {
+	chmod := header.Typeflag != tar.TypeSymlink
 	if header.Typeflag == tar.TypeLink {
-		fi, err := os.Lstat(header.Linkname)
-		if err == nil && (fi.Mode()&os.ModeSymlink == 0) {
-			return os.Chmod(destPath, headerFi.Mode())
+		fi, err := os.Lstat(destPath)
+		chmod = err == nil && (fi.Mode()&os.ModeSymlink == 0)
+	}
+	mode := unpackMode(header, options)
+
+	// an unprivileged owner can only write the rootless ownership xattr, and
+	// any other xattr, while the entry is writable.
+	if chmod && options != nil && options.Rootless {
+		if err := os.Chmod(destPath, mode|0200); err != nil {
+			return newEntryError("chmod", header, destPath, err)
+		}
+	}
+
+	if err := setOwner(destPath, header, uid, gid, existed, options); err != nil {
+		return err
+	}
+
+	if err := restoreXattrs(destPath, header, xattrs, options); err != nil {
+		return err
+	}
+
+	if !chmod {
+		return nil
+	}
+	return newEntryError("chmod", header, destPath, os.Chmod(destPath, mode))
+}
+
+func ignorableXattrError(err error) bool {
+	switch errors.Cause(err) {
+	case syscall.ENOTSUP, syscall.EPERM, syscall.EACCES:
+		return true
+	}
+	return false
+}
+
+// restoreXattrs sets the xattrs recorded in the header, and the ACLs returned
+// by unpackedACLs, according to the policies of their namespaces. It must be
+// called after chown, which clears file capabilities.
+func restoreXattrs(destPath string, header *tar.Header, xattrs map[string]string, options *Options) error {
+	names := make([]string, 0, len(header.Xattrs)+len(xattrs))
+	for name, value := range header.Xattrs {
+		xattrs[name] = value
+	}
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		policy := xattrPolicy(name, options)
+		if policy == XattrsSkip || !xattrAllowed(name, options) {
+			continue
+		}
+
+		err := Lsetxattr(destPath, name, []byte(xattrs[name]), 0)
+		if err != nil && (policy == XattrsRequire || !ignorableXattrError(err)) {
+			return newEntryError("setxattr", header, destPath, errors.Wrap(err, name))
 		}
-	} else if header.Typeflag != tar.TypeSymlink {
-		return os.Chmod(destPath, headerFi.Mode())
 	}
 
 	return nil
@@ -190,7 +373,7 @@ func setMtimeAndAtime(destPath string, header *tar.Header) error {
 
 	// system.Chtimes doesn't support a NOFOLLOW flag atm
 	if header.Typeflag == tar.TypeLink {
-		fi, err := os.Lstat(header.Linkname)
+		fi, err := os.Lstat(destPath)
 		if err == nil && (fi.Mode()&os.ModeSymlink == 0) {
 			return chtimes(destPath, aTime, header.ModTime)
 		}
@@ -203,51 +386,81 @@ func setMtimeAndAtime(destPath string, header *tar.Header) error {
 	return nil
 }
 
-func handleTarEntry(targetPaths map[string]string, fullPath, dest string, header *tar.Header, tr io.Reader, options *Options) error {
-	var err error
+func createEntry(targetPaths map[string]string, fullPath, dest string, header *tar.Header, tr io.Reader, options *Options) error {
 	fi := header.FileInfo()
 
 	switch header.Typeflag {
 	case tar.TypeDir:
-		err = createDirectory(fullPath, fi)
+		return createDirectory(fullPath, fi)
 	case tar.TypeReg, tar.TypeRegA:
 		if _, ok := targetPaths[header.Name]; ok {
-			return errors.Wrapf(errInvalidLink, "%q: file already exists", header.Name)
+			return errors.Wrap(ErrInvalidLink, "file already exists")
 		}
-		err = createFile(fullPath, fi, tr)
 		targetPaths[header.Name] = fullPath
+		return createFile(fullPath, fi, tr, options != nil && options.Sparse)
 	case tar.TypeLink:
 		if targ, ok := targetPaths[header.Linkname]; header.Linkname != "" && ok {
-			if err := os.Link(targ, fullPath); err != nil {
-				err = errors.Wrapf(errInvalidLink, "%s: %v", header.Name, err.Error)
-			}
-		} else {
-			err = errors.Wrapf(errInvalidLink, "%s: invalid link name", header.Name)
+			return os.Link(targ, fullPath)
 		}
+		return errors.Wrapf(ErrInvalidLink, "invalid link name %q", header.Linkname)
 	case tar.TypeBlock, tar.TypeChar, tar.TypeFifo:
-		err = createBlockCharFifo(fullPath, header)
+		return createBlockCharFifo(fullPath, header)
 	case tar.TypeSymlink:
-		err = createSymlink(dest, fullPath, header)
-	default:
-		err = errors.Wrapf(errUnknownHeader, "(type: %c, path: %q)", header.Typeflag, fullPath)
+		return createSymlink(dest, fullPath, header)
 	}
+
+	return ErrUnknownHeader
+}
+
+func handleTarEntry(targetPaths map[string]string, fullPath, dest string, header *tar.Header, tr io.Reader, options *Options) error {
+	uid, gid, err := entryOwner(header, options)
 	if err != nil {
-		return err
+		return newEntryError("chown", header, fullPath, err)
+	}
+
+	acls, err := unpackedACLs(header, options)
+	if err != nil {
+		return newEntryError("setxattr", header, fullPath, err)
 	}
 
-	err = setPermissions(fullPath, header, options)
+	existed, err := removeExisting(fullPath, header)
 	if err != nil {
+		return newEntryError("remove", header, fullPath, err)
+	}
+
+	if err := createEntry(targetPaths, fullPath, dest, header, tr, options); err != nil {
+		return newEntryError("create", header, fullPath, err)
+	}
+
+	if err := setPermissions(fullPath, header, uid, gid, existed, acls, options); err != nil {
 		return err
 	}
 
-	return setMtimeAndAtime(fullPath, header)
+	return newEntryError("chtimes", header, fullPath, setMtimeAndAtime(fullPath, header))
 }
 
-func changeDirTimes(dirs []*tar.Header, dest string) error {
+// changeDirTimes sets the times of the directories unpacked, once nothing
+// else will be created in them, and in rootless mode their final mode.
+func changeDirTimes(dirs []*tar.Header, res *resolver, options *Options) error {
 	for _, hdr := range dirs {
-		path := filepath.Join(dest, hdr.Name)
+		path, err := res.resolve(hdr.Name)
+		if err != nil {
+			return newEntryError("resolve", hdr, path, err)
+		}
+
+		// a later entry may have replaced the directory
+		if fi, err := os.Lstat(path); err != nil || !fi.IsDir() {
+			continue
+		}
+
+		if options != nil && options.Rootless {
+			if err := os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+				return newEntryError("chmod", hdr, path, err)
+			}
+		}
+
 		if err := chtimes(path, hdr.AccessTime, hdr.ModTime); err != nil {
-			return err
+			return newEntryError("chtimes", hdr, path, err)
 		}
 	}
 	return nil
@@ -259,8 +472,8 @@ func createDest(dest string) error {
 		if err := os.MkdirAll(dest, 0700); err != nil {
 			return errors.Wrap(err, dest)
 		}
-	} else if os.IsExist(err) && !fi.IsDir() {
-		return errors.Wrap(errRead, "destination is not a directory")
+	} else if err == nil && !fi.IsDir() {
+		return errors.Wrap(ErrPathIsNonDirectory, dest)
 	} else if err != nil {
 		return errors.Wrap(err, dest)
 	}
@@ -268,21 +481,43 @@ func createDest(dest string) error {
 	return nil
 }
 
-// Unpack unpacks a tar file into the destination.
-func Unpack(ctx context.Context, r io.Reader, dest string, options *Options) error {
-	if err := createDest(dest); err != nil {
-		return err
+// digestReader computes the size of everything read through it, and its
+// digest if it has a digester.
+type digestReader struct {
+	r        io.Reader
+	digester digest.Digester
+	n        int64
+}
+
+func newDigestReader(r io.Reader, wantDigest bool) *digestReader {
+	d := &digestReader{r: r}
+	if wantDigest {
+		d.digester = digest.Canonical.Digester()
+	}
+	return d
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if d.digester != nil {
+		d.digester.Hash().Write(p[:n])
 	}
+	d.n += int64(n)
+	return n, err
+}
 
-	tr := tar.NewReader(r)
-	unpackedPaths := make(stringMap)
-	targetPaths := map[string]string{}
+func unpackEntries(ctx context.Context, tr *tar.Reader, res *resolver, options *Options) (int, error) {
+	var (
+		unpackedPaths = make(stringMap)
+		targetPaths   = map[string]string{}
+		dirs          []*tar.Header
+		entries       int
+	)
 
-	var dirs []*tar.Header
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return entries, ctx.Err()
 		default:
 		}
 
@@ -292,14 +527,26 @@ func Unpack(ctx context.Context, r io.Reader, dest string, options *Options) err
 		}
 
 		if err != nil {
-			return errors.Wrap(errRead, err.Error())
+			return entries, errors.Wrap(err, "reading tar header")
+		}
+		entries++
+
+		consumed, err := applyWhiteout(res, hdr, unpackedPaths, options)
+		if err != nil {
+			return entries, err
+		}
+		if consumed {
+			continue
 		}
 
-		fullPath := filepath.Join(dest, hdr.Name)
+		fullPath, err := res.resolve(hdr.Name)
+		if err != nil {
+			return entries, newEntryError("resolve", hdr, fullPath, err)
+		}
 
-		if hdr.Name != "/" && hdr.Name != "." {
-			if err := handleTarEntry(targetPaths, fullPath, dest, hdr, tr, options); err != nil {
-				return err
+		if fullPath != res.root {
+			if err := handleTarEntry(targetPaths, fullPath, res.root, hdr, tr, options); err != nil {
+				return entries, err
 			}
 		}
 
@@ -309,14 +556,101 @@ func Unpack(ctx context.Context, r io.Reader, dest string, options *Options) err
 		unpackedPaths[fullPath] = struct{}{}
 	}
 
-	return changeDirTimes(dirs, dest)
+	return entries, changeDirTimes(dirs, res, options)
+}
+
+func verifyDigest(kind string, expected, actual digest.Digest) error {
+	if expected == "" || expected == actual {
+		return nil
+	}
+
+	return errors.Wrapf(ErrDigestMismatch, "%s: expected %s, got %s", kind, expected, actual)
+}
+
+func unpack(ctx context.Context, r io.Reader, dest string, options *Options, wantResult bool) (*Result, error) {
+	if err := createDest(dest); err != nil {
+		return nil, err
+	}
+
+	res, err := newResolver(dest)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	verify := options != nil && (options.ExpectedDigest != "" || options.ExpectedDiffID != "")
+	wantDigests := wantResult || verify
+
+	raw := newDigestReader(&ctxReader{ctx: ctx, r: r}, wantDigests)
+	dr, err := Decompress(raw, options)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	tarStream := newDigestReader(dr, wantDigests)
+	entries, err := unpackEntries(ctx, tar.NewReader(tarStream), res, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if !wantDigests {
+		return nil, nil
+	}
+
+	// the digests cover the padding after the end of the archive as well
+	if _, err := io.Copy(ioutil.Discard, tarStream); err != nil {
+		return nil, errors.Wrap(err, "reading tar stream")
+	}
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return nil, errors.Wrap(err, "reading tar stream")
+	}
+
+	result := &Result{
+		DiffID:           tarStream.digester.Digest(),
+		Digest:           raw.digester.Digest(),
+		Size:             raw.n,
+		UncompressedSize: tarStream.n,
+		Entries:          entries,
+	}
+
+	if verify {
+		if err := verifyDigest("digest", options.ExpectedDigest, result.Digest); err != nil {
+			return nil, err
+		}
+		if err := verifyDigest("diffID", options.ExpectedDiffID, result.DiffID); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Unpack unpacks a tar file into the destination. Compressed streams are
+// decompressed according to the options. If ctx is canceled, Unpack stops,
+// even in the middle of a file, and returns an error wrapping ctx.Err(); the
+// file being written is removed, but entries already unpacked are kept.
+// Entries are never written, nor whiteouts applied, outside of dest through
+// their names or the symlinks of the archive; paths are checked before each
+// entry is handled, so dest must not be modified by anyone else while
+// unpacking.
+func Unpack(ctx context.Context, r io.Reader, dest string, options *Options) error {
+	_, err := unpack(ctx, r, dest, options, false)
+	return err
+}
+
+// UnpackWithResult unpacks a tar file into the destination like Unpack, and
+// reads the rest of the stream to return its digests, sizes and number of
+// entries.
+func UnpackWithResult(ctx context.Context, r io.Reader, dest string, options *Options) (*Result, error) {
+	return unpack(ctx, r, dest, options, true)
 }
 
 // OpenAndUnpack unpacks a specified file into the destination.
 func OpenAndUnpack(ctx context.Context, layerPath, dest string, options *Options) error {
 	tarFile, err := os.Open(layerPath)
 	if err != nil {
-		return errors.Wrap(errFailedOpen, layerPath)
+		return err
 	}
 	defer tarFile.Close()
 
@@ -2,11 +2,15 @@ package tarutil
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 
 	digest "github.com/opencontainers/go-digest"
@@ -40,7 +44,7 @@ func TestUntarBadLink(t *testing.T) {
 	}
 
 	err = Unpack(context.Background(), pr, dir, nil)
-	if errors.Cause(err) != errInvalidLink {
+	if !errors.Is(err, ErrInvalidLink) {
 		t.Fatal("processed invalid hard links")
 	}
 
@@ -61,7 +65,7 @@ func TestUntarBadLink(t *testing.T) {
 	}()
 
 	err = Unpack(context.Background(), pr, dir, nil)
-	if errors.Cause(err) != errInvalidLink {
+	if !errors.Is(err, ErrInvalidLink) {
 		t.Fatalf("processed invalid hard links: actual error: %v", err)
 	}
 }
@@ -142,3 +146,318 @@ func TestUntarReader(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUntarWhiteouts(t *testing.T) {
+	base, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	dir := filepath.Join(base, "dest")
+	if err := ioutil.WriteFile(filepath.Join(base, "sibling"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lower := generateTarFromHeaders([]tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/a", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/b", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "c", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "keep", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+
+	if err := Unpack(context.Background(), lower, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	upper := generateTarFromHeaders([]tar.Header{
+		{Name: whiteoutPrefix + "c", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/" + whiteoutOpaqueDir, Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/d", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+
+	if err := Unpack(context.Background(), upper, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"c", whiteoutPrefix + "c", "dir/a", "dir/b", "dir/" + whiteoutOpaqueDir} {
+		if _, err := os.Lstat(filepath.Join(dir, p)); !os.IsNotExist(err) {
+			t.Fatalf("%q should not exist after applying whiteouts", p)
+		}
+	}
+
+	for _, p := range []string{"keep", "dir/d"} {
+		if _, err := os.Lstat(filepath.Join(dir, p)); err != nil {
+			t.Fatalf("%q should exist after applying whiteouts: %v", p, err)
+		}
+	}
+
+	for _, name := range []string{whiteoutPrefix, whiteoutPrefix + ".", whiteoutPrefix + "..", "dir/" + whiteoutPrefix + ".."} {
+		for _, mode := range []WhiteoutMode{WhiteoutsApply, WhiteoutsOverlay} {
+			r := generateTarFromHeaders([]tar.Header{{Name: name, Typeflag: tar.TypeReg, Mode: 0644}})
+			err := Unpack(context.Background(), r, dir, &Options{Whiteouts: mode})
+			if !errors.Is(err, ErrInvalidWhiteout) {
+				t.Fatalf("%q: expected an invalid whiteout error, got %v", name, err)
+			}
+		}
+
+		for _, p := range []string{"keep", "dir/d", "../sibling"} {
+			if _, err := os.Lstat(filepath.Join(dir, p)); err != nil {
+				t.Fatalf("%q: %q was removed: %v", name, p, err)
+			}
+		}
+	}
+}
+
+func TestUntarKeepWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := generateTarFromHeaders([]tar.Header{
+		{Name: "c", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: whiteoutPrefix + "c", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+
+	if err := Unpack(context.Background(), r, dir, &Options{Whiteouts: WhiteoutsKeep}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"c", whiteoutPrefix + "c"} {
+		if _, err := os.Lstat(filepath.Join(dir, p)); err != nil {
+			t.Fatalf("%q should exist when keeping whiteouts: %v", p, err)
+		}
+	}
+}
+
+func TestUntarOverlayWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := generateTarFromHeaders([]tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/" + whiteoutOpaqueDir, Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/a", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: whiteoutPrefix + "gone", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+
+	err = Unpack(context.Background(), r, dir, &Options{Whiteouts: WhiteoutsOverlay})
+	if cause := errors.Cause(err); cause == syscall.EPERM || cause == syscall.ENOTSUP {
+		t.Skipf("overlay xattrs are not supported here: %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dir, "gone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 || fi.Sys().(*syscall.Stat_t).Rdev != 0 {
+		t.Fatalf("expected a 0/0 character device, got mode %v", fi.Mode())
+	}
+
+	opaque, err := Lgetxattr(filepath.Join(dir, "dir"), overlayOpaqueXattr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opaque) != overlayOpaqueXattrValue {
+		t.Fatalf("expected dir to be opaque, got %q", opaque)
+	}
+
+	for _, p := range []string{whiteoutPrefix + "gone", "dir/" + whiteoutOpaqueDir} {
+		if _, err := os.Lstat(filepath.Join(dir, p)); !os.IsNotExist(err) {
+			t.Fatalf("%q should not exist in overlay mode", p)
+		}
+	}
+}
+
+func TestUntarEntryError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := generateTarFromHeaders([]tar.Header{
+		{Name: "dir", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/missing/file", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+
+	err = Unpack(context.Background(), r, dir, nil)
+
+	var entryErr *EntryError
+	if !errors.As(err, &entryErr) {
+		t.Fatalf("expected an *EntryError, got %v", err)
+	}
+
+	if entryErr.Op != "resolve" || entryErr.Name != "dir/missing/file" || entryErr.Typeflag != tar.TypeReg {
+		t.Fatalf("unexpected error details: %#v", entryErr)
+	}
+
+	if entryErr.Path != filepath.Join(dir, "dir/missing/file") {
+		t.Fatalf("unexpected path %q", entryErr.Path)
+	}
+
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("underlying error was lost: %v", err)
+	}
+}
+
+func TestUntarResult(t *testing.T) {
+	packDir, _, err := generateFiles(5, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	buf := new(bytes.Buffer)
+	packResult, err := PackWithResult(context.Background(), packDir, buf, &Options{Compression: Gzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	result, err := UnpackWithResult(context.Background(), bytes.NewReader(data), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *result != *packResult {
+		t.Fatalf("unpack result %+v does not match pack result %+v", result, packResult)
+	}
+
+	if result.Entries != 5*3 {
+		t.Fatalf("expected %d entries, got %d", 5*3, result.Entries)
+	}
+
+	err = Unpack(context.Background(), bytes.NewReader(data), dir, &Options{ExpectedDiffID: emptyDigest})
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+
+	err = Unpack(context.Background(), bytes.NewReader(data), dir, &Options{ExpectedDiffID: packResult.DiffID, ExpectedDigest: packResult.Digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUntarCancel(t *testing.T) {
+	const size = 8 << 20
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: size}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(tw, io.LimitReader(zeroReader{}, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = Unpack(ctx, &cancelingReader{r: buf, n: 1 << 20, cancel: cancel}, dir, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the unpack to be canceled, got %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "big")); !os.IsNotExist(err) {
+		t.Fatalf("partially written file was left behind: %v", err)
+	}
+}
+
+func TestUntarXattrs(t *testing.T) {
+	packDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packDir)
+
+	file := filepath.Join(packDir, "file")
+	if err := ioutil.WriteFile(file, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs := map[string]string{
+		"user.small": "value",
+		"user.large": strings.Repeat("x", 1000),
+	}
+	for name, value := range xattrs {
+		if err := Lsetxattr(file, name, []byte(value), 0); err != nil {
+			t.Skipf("cannot set user xattrs here: %v", err)
+		}
+	}
+
+	for _, options := range []*Options{nil, {XattrNamespaces: []string{"security"}}} {
+		buf := new(bytes.Buffer)
+		if err := PackWithOptions(context.Background(), packDir, buf, options); err != nil {
+			t.Fatal(err)
+		}
+
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := Unpack(context.Background(), buf, dir, &Options{NoLchown: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, value := range xattrs {
+			restored, err := Lgetxattr(filepath.Join(dir, "file"), name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if options == nil && string(restored) != value {
+				t.Fatalf("xattr %q was not restored: %q", name, restored)
+			} else if options != nil && restored != nil {
+				t.Fatalf("xattr %q was packed outside the allowed namespaces", name)
+			}
+		}
+	}
+
+	// user xattrs are not permitted on symlinks.
+	headers := []tar.Header{
+		{Name: "link", Linkname: "file", Typeflag: tar.TypeSymlink, Xattrs: map[string]string{"user.small": "value"}},
+	}
+
+	for _, policy := range []XattrPolicy{XattrsBestEffort, XattrsRequire} {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		options := &Options{NoLchown: true, XattrPolicies: map[string]XattrPolicy{"user": policy}}
+		err = Unpack(context.Background(), generateTarFromHeaders(headers), dir, options)
+		if policy == XattrsBestEffort && err != nil {
+			t.Fatal(err)
+		} else if policy == XattrsRequire && !errors.Is(err, syscall.EPERM) {
+			t.Fatalf("expected the xattr to be required, got %v", err)
+		}
+	}
+}
@@ -4,6 +4,12 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
 )
 
 func generateTar(numEntries int) io.Reader {
@@ -31,6 +37,23 @@ func generateTar(numEntries int) io.Reader {
 			tw.WriteHeader(&h)
 		}
 		tw.Close()
+		pw.Close()
+	}()
+
+	return pr
+}
+
+func generateTarFromHeaders(headers []tar.Header) io.Reader {
+	var (
+		pr, pw = io.Pipe()
+	)
+	go func() {
+		tw := tar.NewWriter(pw)
+		for i := range headers {
+			tw.WriteHeader(&headers[i])
+		}
+		tw.Close()
+		pw.Close()
 	}()
 
 	return pr
@@ -75,3 +98,77 @@ func loopTarAndReturnHeaders(r io.Reader) ([]*tar.Header, error) {
 	}
 	return headers, nil
 }
+
+// cancelingReader calls cancel once more than n bytes have been read.
+type cancelingReader struct {
+	r      io.Reader
+	n      int64
+	cancel func()
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.n -= int64(n); c.n < 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+// cancelingWriter calls cancel once more than n bytes have been written.
+type cancelingWriter struct {
+	w      io.Writer
+	n      int64
+	cancel func()
+}
+
+func (c *cancelingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if c.n -= int64(n); c.n < 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// runUnprivileged runs the named test again in a copy of the test binary as
+// the nobody user, failing t if it fails.
+func runUnprivileged(t *testing.T, name string) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	binary, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBinary := filepath.Join(dir, "tarutil.test")
+	if err := ioutil.WriteFile(testBinary, binary, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(testBinary, "-test.run", "^"+name+"$", "-test.v")
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		t.Skipf("cannot run the test as nobody: %v", err)
+	} else if err != nil {
+		t.Fatalf("%v failed as nobody: %v\n%s", name, err, out)
+	}
+}
@@ -3,6 +3,7 @@ package tarutil
 // taken from github.com/docker/docker/pkg/system/xattrs_linux.go
 
 import (
+	"bytes"
 	"syscall"
 	"unsafe"
 )
@@ -27,6 +28,14 @@ func Lgetxattr(path string, attr string) ([]byte, error) {
 		return nil, nil
 	}
 	if errno == syscall.ERANGE {
+		// on failure sz is not the size needed, so ask for it.
+		sz, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(attrBytes)), 0, 0, 0, 0)
+		if errno != 0 {
+			return nil, errno
+		}
+		if sz == 0 {
+			return []byte{}, nil
+		}
 		dest = make([]byte, sz)
 		destBytes := unsafe.Pointer(&dest[0])
 		sz, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(attrBytes)), uintptr(destBytes), uintptr(len(dest)), 0, 0)
@@ -38,6 +47,43 @@ func Lgetxattr(path string, attr string) ([]byte, error) {
 	return dest[:sz], nil
 }
 
+// Llistxattr lists the names of the extended attributes associated with the
+// given path in the file system. It returns no names and a nil error if the
+// file system does not support xattrs.
+func Llistxattr(path string) ([]string, error) {
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dest := make([]byte, 128)
+	for {
+		destBytes := unsafe.Pointer(&dest[0])
+		sz, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(destBytes), uintptr(len(dest)))
+		switch errno {
+		case 0:
+			return splitXattrNames(dest[:sz]), nil
+		case syscall.ENOTSUP:
+			return nil, nil
+		case syscall.ERANGE:
+			// the list may grow between calls, so keep growing the buffer.
+			dest = make([]byte, len(dest)*2)
+		default:
+			return nil, errno
+		}
+	}
+}
+
+func splitXattrNames(list []byte) []string {
+	names := []string{}
+	for _, name := range bytes.Split(list, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names
+}
+
 var _zero uintptr
 
 // Lsetxattr sets the value of the extended attribute identified by attr